@@ -11,12 +11,17 @@ import (
 	"os"
 	"os/signal"
 	"ratelimiter/internal/config"
+	"ratelimiter/internal/envoy"
 	"ratelimiter/internal/handlers"
+	"ratelimiter/internal/proxy"
 	"ratelimiter/internal/rate_limiter"
 	"ratelimiter/internal/repositories"
+	"ratelimiter/pkg/ratelimit"
 	"time"
 
 	"syscall"
+
+	"google.golang.org/grpc"
 )
 
 func main() {
@@ -27,6 +32,14 @@ func main() {
 
 	log := mustMakeLogger(cfg.LogLevel)
 
+	ctx, stop := signal.NotifyContext(
+		context.Background(),
+		os.Interrupt,
+		syscall.SIGTERM,
+		syscall.SIGQUIT,
+	)
+	defer stop()
+
 	dsn := fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%s sslmode=disable",
 		cfg.DBHost, cfg.DBUser, cfg.DBPassword, cfg.DBName, cfg.DBPort)
 
@@ -44,49 +57,232 @@ func main() {
 
 	store := rate_limiter.NewBucketStore()
 	go store.StartBackgroundRefill(100 * time.Millisecond)
+	go store.StartEviction(time.Minute)
 
-	clientsFromDB, err := storage.ListClients(context.Background())
-	if err != nil {
+	if cfg.Peers.Self != "" {
+		if cfg.Peers.Secret == "" {
+			log.Error("invalid peers config, secret is required")
+			os.Exit(1)
+		}
+		peers := rate_limiter.NewPeerGroup(log, cfg.Peers.Self, cfg.Peers.Secret, cfg.Peers.Members, cfg.Peers.Timeout)
+		if cfg.Peers.DNSName != "" {
+			go peers.StartDNSDiscovery(ctx, cfg.Peers.DNSName, cfg.Peers.DNSPort, cfg.Peers.DNSRefresh)
+		}
+		store.UsePeers(peers)
+	}
+
+	if cfg.GlobalQuota.Enabled {
+		instance := cfg.GlobalQuota.Instance
+		if instance == "" {
+			instance, err = os.Hostname()
+			if err != nil {
+				log.Error("failed to get hostname for quota instance", "error", err)
+				os.Exit(1)
+			}
+		}
+		log.Info("syncing global quotas", "instance", instance, "interval", cfg.GlobalQuota.SyncInterval)
+		go rate_limiter.NewQuotaSyncer(log, store, storage, instance, cfg.GlobalQuota.SyncInterval).Start(ctx)
+	}
+
+	origin := rate_limiter.NewOrigin()
+
+	if err := rate_limiter.LoadClients(ctx, log, storage, store); err != nil {
 		log.Error("failed to list clients", "error", err)
-	} else {
-		for _, cl := range clientsFromDB {
-			log.Info("Loading client from DB into BucketStore",
-				"key", cl.Key,
-				"capacity", cl.Capacity,
-				"refill_rate", cl.RefillRate.String(),
-				"unlimited", cl.Unlimited,
-			)
+	}
+
+	rules := rate_limiter.NewRuleSet(log, storage, store)
+	if err := rules.Load(ctx); err != nil {
+		log.Error("failed to load rules", "error", err)
+	}
+
+	accessLists := rate_limiter.NewAccessLists(log, storage)
+	if err := accessLists.Load(ctx); err != nil {
+		log.Error("failed to load access lists", "error", err)
+	}
 
-			store.Set(cl.Key, rate_limiter.NewTokenBucket(
-				cl.Capacity,
-				cl.RefillRate,
-				cl.Unlimited,
-			))
+	bans := rate_limiter.NewBans(log, storage, cfg.Bans)
+	if cfg.Bans.Enabled {
+		if cfg.Bans.MaxRejections < 1 || cfg.Bans.Window <= 0 || cfg.Bans.BanTime <= 0 || cfg.Bans.MaxBanTime < cfg.Bans.BanTime {
+			log.Error("invalid bans config, max_rejections, window and ban_time must be positive and max_ban_time at least ban_time")
+			os.Exit(1)
 		}
+		if err := bans.Load(ctx); err != nil {
+			log.Error("failed to load bans", "error", err)
+		}
+		go bans.Start(ctx)
+	}
+
+	go rate_limiter.Watch(ctx, log, storage,
+		rate_limiter.ClientChanges(log, storage, store, origin),
+		rules,
+		accessLists,
+		bans,
+	)
+
+	lookup := rate_limiter.NewClientLookup(log, storage,
+		cfg.Lookup.NegativeTTL,
+		cfg.Lookup.NegativeCacheSize,
+		cfg.Lookup.MaxDBLookupsPerSecond,
+	)
+
+	limiter := rate_limiter.NewLimiter(store, cfg.DefaultLimit, cfg.Anonymous, lookup)
+
+	ips, err := ratelimit.NewIPResolver(cfg.TrustedProxies)
+	if err != nil {
+		log.Error("invalid trusted proxies config", "error", err)
+		os.Exit(1)
 	}
 
+	keys, err := rate_limiter.NewKeyChain(cfg.Identification.Extractors, ips)
+	if err != nil {
+		log.Error("invalid client identification config", "error", err)
+		os.Exit(1)
+	}
+
+	reject, err := rate_limiter.NewRejectHandler(log, cfg.Rejections.Routes)
+	if err != nil {
+		log.Error("invalid rejections config", "error", err)
+		os.Exit(1)
+	}
+
+	sizes, err := rate_limiter.NewSizeGuard(log, cfg.RequestLimits, store)
+	if err != nil {
+		log.Error("invalid request limits config", "error", err)
+		os.Exit(1)
+	}
+
+	limitOpts := []ratelimit.Option{
+		ratelimit.WithKeys(keys...),
+		ratelimit.WithRejectHandler(reject),
+		ratelimit.WithIPResolver(ips),
+		ratelimit.WithAccessList(accessLists),
+		ratelimit.WithSizeGuard(sizes),
+		ratelimit.WithShadowRejectHook(func(r *http.Request, key string, res ratelimit.Result) {
+			log.Info("request would have been rejected by a limit in shadow mode",
+				"key", key,
+				"method", r.Method,
+				"path", r.URL.Path,
+				"limit", res.Limit,
+				"retry_after", res.RetryAfter.String(),
+			)
+		}),
+	}
+	if cfg.Identification.RejectUnidentified {
+		limitOpts = append(limitOpts, ratelimit.WithRejectUnidentified())
+	}
+	if cfg.Bans.Enabled {
+		limitOpts = append(limitOpts, ratelimit.WithBans(bans))
+	}
+	if cfg.Connections.MaxPerKey > 0 {
+		limitOpts = append(limitOpts, ratelimit.WithMaxConnections(cfg.Connections.MaxPerKey))
+	}
+	limitOpts = append(limitOpts, ratelimit.WithConnLimits(store, rate_limiter.NewConnLimits(store, cfg.Connections)))
+	var queue *ratelimit.FairQueue
+	if cfg.Queue.Enabled {
+		queue = ratelimit.NewFairQueue(ratelimit.QueueOptions{
+			Concurrency: cfg.Queue.Concurrency,
+			MaxQueue:    cfg.Queue.MaxPerClient,
+			MaxWait:     cfg.Queue.MaxWait,
+			IdleTTL:     cfg.Queue.IdleTTL,
+			Weight: func(key string) int {
+				if weight, ok := cfg.Queue.Weights[key]; ok {
+					return weight
+				}
+				return cfg.Queue.DefaultWeight
+			},
+		})
+		limitOpts = append(limitOpts, ratelimit.WithFairQueue(queue))
+	}
+	if len(cfg.GraphQL.Patterns) > 0 {
+		analyzer, err := rate_limiter.NewGraphQLAnalyzer(cfg.GraphQL)
+		if err != nil {
+			log.Error("invalid graphql config", "error", err)
+			os.Exit(1)
+		}
+		limitOpts = append(limitOpts, ratelimit.WithAnalyzer(analyzer))
+	}
+	if cfg.Headers.Legacy {
+		limitOpts = append(limitOpts, ratelimit.WithLegacyHeaders())
+	}
+	limitMiddleware := ratelimit.NewMiddleware(rate_limiter.NewRouteLimiter(limiter, rules), limitOpts...)
+	rateLimit := limitMiddleware.Handler
+	check := rate_limiter.CheckHandler(limitMiddleware, cfg.ForwardAuth.DenyStatus)
+
 	mux := http.NewServeMux()
 	mux.Handle("POST /clients", handlers.AddClientHandler(log, storage, store))
-	mux.Handle("PUT /clients/{clientID}", handlers.EditClientHandler(log, storage))
+	mux.Handle("PUT /clients/{clientID}", handlers.EditClientHandler(log, storage, store, origin))
 	mux.Handle("GET /clients", handlers.ListClientsHandler(log, storage))
 	mux.Handle("GET /clients/{clientID}", handlers.GetClientHandler(log, storage))
 	mux.Handle("DELETE /clients/{clientID}", handlers.DeleteClientHandler(log, storage, store))
-	mux.Handle("/api", rate_limiter.RateLimitMiddleware(store, cfg.DefaultLimit, storage)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "Request allowed\n")
-	})))
+	mux.Handle("GET /clients/{clientID}/bucket", handlers.GetBucketHandler(log, store))
+	mux.Handle("POST /clients/{clientID}/bucket/reset", handlers.ResetBucketHandler(log, store))
+	mux.Handle("POST /rules", handlers.AddRuleHandler(log, storage, rules))
+	mux.Handle("GET /rules", handlers.ListRulesHandler(log, storage))
+	mux.Handle("GET /rules/{ruleID}", handlers.GetRuleHandler(log, storage))
+	mux.Handle("PUT /rules/{ruleID}", handlers.EditRuleHandler(log, storage, rules))
+	mux.Handle("DELETE /rules/{ruleID}", handlers.DeleteRuleHandler(log, storage, rules))
+	mux.Handle("GET /buckets", handlers.ListBucketsHandler(log, store))
+	mux.Handle("POST /allowlist", handlers.AddAccessEntryHandler(log, storage, accessLists, repositories.AllowList))
+	mux.Handle("GET /allowlist", handlers.ListAccessEntriesHandler(log, storage, repositories.AllowList))
+	mux.Handle("DELETE /allowlist/{entryID}", handlers.DeleteAccessEntryHandler(log, storage, accessLists, repositories.AllowList))
+	mux.Handle("POST /denylist", handlers.AddAccessEntryHandler(log, storage, accessLists, repositories.DenyList))
+	mux.Handle("GET /denylist", handlers.ListAccessEntriesHandler(log, storage, repositories.DenyList))
+	mux.Handle("DELETE /denylist/{entryID}", handlers.DeleteAccessEntryHandler(log, storage, accessLists, repositories.DenyList))
+	mux.Handle("GET /bans", handlers.ListBansHandler(log, storage))
+	mux.Handle("GET /bans/{key}", handlers.GetBanHandler(log, storage))
+	mux.Handle("DELETE /bans/{key}", handlers.LiftBanHandler(log, bans))
+	mux.Handle("GET /queues", handlers.ListQueuesHandler(log, queue))
+	mux.Handle("GET /rejections/size", handlers.ListSizeRejectionsHandler(log, sizes))
+	mux.Handle(rate_limiter.CheckPath, check)
+	mux.Handle(rate_limiter.CheckPath+"/", check)
+	if cfg.Peers.Self != "" {
+		mux.Handle("POST "+rate_limiter.PeerAllowPath, handlers.PeerAllowHandler(log, store, cfg.Peers.Secret))
+	}
 
-	ctx, stop := signal.NotifyContext(
-		context.Background(),
-		os.Interrupt,
-		syscall.SIGTERM,
-		syscall.SIGQUIT,
-	)
-	defer stop()
+	if len(cfg.Proxy.Routes) == 0 {
+		mux.Handle("/api", rateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "Request allowed\n")
+		})))
+	}
+
+	transport := proxy.NewTransport(cfg.Proxy)
+	for _, route := range cfg.Proxy.Routes {
+		upstream, err := proxy.New(log, route, transport, cfg.Proxy.FlushInterval)
+		if err != nil {
+			log.Error("invalid proxy route", "prefix", route.Prefix, "error", err)
+			os.Exit(1)
+		}
+		log.Info("Proxying route", "prefix", route.Prefix, "upstream", route.Upstream)
+		mux.Handle(route.Prefix, rateLimit(upstream))
+	}
+
+	if cfg.Envoy.Address != "" {
+		lis, err := net.Listen("tcp", cfg.Envoy.Address)
+		if err != nil {
+			log.Error("failed to listen for envoy rate limit service", "error", err)
+			os.Exit(1)
+		}
+
+		grpcServer := grpc.NewServer()
+		envoy.New(log, limiter, rules, cfg.Envoy, cfg.Headers.Legacy).Register(grpcServer)
+
+		go func() {
+			<-ctx.Done()
+			grpcServer.GracefulStop()
+		}()
+		go func() {
+			log.Info("Running envoy rate limit service", "address", cfg.Envoy.Address)
+			if err := grpcServer.Serve(lis); err != nil {
+				log.Error("envoy rate limit service stopped", "error", err)
+			}
+		}()
+	}
 
 	server := http.Server{
-		Addr:        cfg.Address,
-		Handler:     mux,
-		BaseContext: func(_ net.Listener) context.Context { return ctx },
+		Addr:              cfg.Address,
+		Handler:           mux,
+		BaseContext:       func(_ net.Listener) context.Context { return ctx },
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
 	}
 
 	log.Info("Starting server", "address", cfg.Address)
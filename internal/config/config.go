@@ -3,20 +3,48 @@ package config
 import (
 	"log"
 	"ratelimiter/internal/models"
+	"time"
 
 	"github.com/ilyakaznacheev/cleanenv"
 )
 
 type Config struct {
-	Address          string               `yaml:"address" env:"ADDRESS" env-default:":8080"`
-	LogLevel         string               `yaml:"log_level" env:"LOG_LEVEL" env-default:"DEBUG"`
-	DefaultLimit     models.Limit         `yaml:"default_limit" env:"DEFAULT_LIMIT"`
-	ClientRateLimits []models.ClientLimit `yaml:"client_rate_limits" env:"CLIENT_RATE_LIMITS"`
-	DBHost           string               `env:"DB_HOST" env-default:"db"`
-	DBUser           string               `env:"DB_USER" env-default:"postgres"`
-	DBPassword       string               `env:"DB_PASSWORD" env-default:"postgres"`
-	DBName           string               `env:"DB_NAME" env-default:"postgres"`
-	DBPort           string               `env:"DB_PORT" env-default:"5432"`
+	Address           string                  `yaml:"address" env:"ADDRESS" env-default:":8080"`
+	ReadHeaderTimeout time.Duration           `yaml:"read_header_timeout" env:"READ_HEADER_TIMEOUT" env-default:"10s"`
+	LogLevel          string                  `yaml:"log_level" env:"LOG_LEVEL" env-default:"DEBUG"`
+	DefaultLimit      models.Limit            `yaml:"default_limit" env:"DEFAULT_LIMIT"`
+	Anonymous         models.AnonymousLimits  `yaml:"anonymous"`
+	ClientRateLimits  []models.ClientLimit    `yaml:"client_rate_limits" env:"CLIENT_RATE_LIMITS"`
+	Headers           models.RateLimitHeaders `yaml:"headers"`
+	Identification    models.Identification   `yaml:"identification"`
+	ForwardAuth       models.ForwardAuth      `yaml:"forward_auth"`
+	Rejections        models.Rejections       `yaml:"rejections"`
+	Bans              models.Bans             `yaml:"bans"`
+	Connections       models.Connections      `yaml:"connections"`
+	Queue             models.Queue            `yaml:"queue"`
+	GraphQL           models.GraphQL          `yaml:"graphql"`
+	RequestLimits     models.RequestLimits    `yaml:"request_limits"`
+	Proxy             models.ProxyConfig      `yaml:"proxy"`
+	Envoy             models.Envoy            `yaml:"envoy"`
+	TrustedProxies    []string                `yaml:"trusted_proxies" env:"TRUSTED_PROXIES" env-separator:","`
+	DBHost            string                  `env:"DB_HOST" env-default:"db"`
+	DBUser            string                  `env:"DB_USER" env-default:"postgres"`
+	DBPassword        string                  `env:"DB_PASSWORD" env-default:"postgres"`
+	DBName            string                  `env:"DB_NAME" env-default:"postgres"`
+	DBPort            string                  `env:"DB_PORT" env-default:"5432"`
+	Peers             PeersConfig             `yaml:"peers"`
+	GlobalQuota       GlobalQuotaConfig       `yaml:"global_quota"`
+	Lookup            LookupConfig            `yaml:"lookup"`
+}
+
+type PeersConfig struct {
+	Self       string        `yaml:"self" env:"PEERS_SELF"`
+	Secret     string        `yaml:"secret" env:"PEERS_SECRET"`
+	Members    []string      `yaml:"members" env:"PEERS_MEMBERS" env-separator:","`
+	DNSName    string        `yaml:"dns_name" env:"PEERS_DNS_NAME"`
+	DNSPort    string        `yaml:"dns_port" env:"PEERS_DNS_PORT" env-default:"8080"`
+	DNSRefresh time.Duration `yaml:"dns_refresh" env:"PEERS_DNS_REFRESH" env-default:"10s"`
+	Timeout    time.Duration `yaml:"timeout" env:"PEERS_TIMEOUT" env-default:"200ms"`
 }
 
 func MustLoad(configPath string) Config {
@@ -26,3 +54,15 @@ func MustLoad(configPath string) Config {
 	}
 	return cfg
 }
+
+type GlobalQuotaConfig struct {
+	Enabled      bool          `yaml:"enabled" env:"GLOBAL_QUOTA_ENABLED"`
+	Instance     string        `yaml:"instance" env:"GLOBAL_QUOTA_INSTANCE"`
+	SyncInterval time.Duration `yaml:"sync_interval" env:"GLOBAL_QUOTA_SYNC_INTERVAL" env-default:"200ms"`
+}
+
+type LookupConfig struct {
+	NegativeTTL           time.Duration `yaml:"negative_ttl" env:"LOOKUP_NEGATIVE_TTL" env-default:"1m"`
+	NegativeCacheSize     int           `yaml:"negative_cache_size" env:"LOOKUP_NEGATIVE_CACHE_SIZE" env-default:"100000"`
+	MaxDBLookupsPerSecond int64         `yaml:"max_db_lookups_per_second" env:"LOOKUP_MAX_DB_LOOKUPS_PER_SECOND" env-default:"100"`
+}
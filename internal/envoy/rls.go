@@ -0,0 +1,240 @@
+package envoy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"ratelimiter/internal/models"
+	"ratelimiter/internal/rate_limiter"
+	"ratelimiter/pkg/ratelimit"
+)
+
+// Server implements the Envoy rate limit service. Every descriptor is
+// checked on its own:
+//   - a descriptor with a limit override gets a bucket with that limit,
+//   - one with a path entry is matched against the rules,
+//   - one with a client key entry or a remote_address entry is limited like
+//     an HTTP request from that client,
+//   - any other descriptor is limited by the client whose key is the domain
+//     followed by the entries, e.g. "edge:tenant=acme,plan=free", or by the
+//     default limit.
+type Server struct {
+	rlsv3.UnimplementedRateLimitServiceServer
+
+	log     *slog.Logger
+	limiter *rate_limiter.Limiter
+	rules   *rate_limiter.RuleSet
+	cfg     models.Envoy
+	legacy  bool
+}
+
+func New(log *slog.Logger, limiter *rate_limiter.Limiter, rules *rate_limiter.RuleSet, cfg models.Envoy, legacyHeaders bool) *Server {
+	return &Server{
+		log:     log,
+		limiter: limiter,
+		rules:   rules,
+		cfg:     cfg,
+		legacy:  legacyHeaders,
+	}
+}
+
+func (s *Server) Register(g *grpc.Server) {
+	rlsv3.RegisterRateLimitServiceServer(g, s)
+}
+
+func (s *Server) ShouldRateLimit(ctx context.Context, req *rlsv3.RateLimitRequest) (*rlsv3.RateLimitResponse, error) {
+	if req.GetDomain() == "" {
+		return nil, status.Error(codes.InvalidArgument, "domain is required")
+	}
+	if len(req.GetDescriptors()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "descriptors are required")
+	}
+
+	resp := &rlsv3.RateLimitResponse{OverallCode: rlsv3.RateLimitResponse_OK}
+
+	var overall ratelimit.Result
+	for i, d := range req.GetDescriptors() {
+		cost := int64(max(1, req.GetHitsAddend()))
+		if d.GetHitsAddend() != nil {
+			cost = int64(min(d.GetHitsAddend().GetValue(), math.MaxInt64))
+		}
+
+		res := s.take(ctx, req.GetDomain(), d, cost)
+		resp.Statuses = append(resp.Statuses, descriptorStatus(res))
+		if !res.Allowed {
+			resp.OverallCode = rlsv3.RateLimitResponse_OVER_LIMIT
+		}
+
+		if i == 0 {
+			overall = res
+		} else {
+			overall = ratelimit.MostRestrictive(overall, res)
+		}
+	}
+
+	h := http.Header{}
+	ratelimit.SetHeaders(h, overall, s.legacy)
+	for _, name := range slices.Sorted(maps.Keys(h)) {
+		resp.ResponseHeadersToAdd = append(resp.ResponseHeadersToAdd, &corev3.HeaderValue{
+			Key:   name,
+			Value: h.Get(name),
+		})
+	}
+
+	s.log.Debug("rate limit decision", "domain", req.GetDomain(), "code", resp.OverallCode)
+	return resp, nil
+}
+
+func (s *Server) take(ctx context.Context, domain string, d *ratelimitv3.RateLimitDescriptor, cost int64) ratelimit.Result {
+	var key, method, path, remote string
+	parts := make([]string, 0, len(d.GetEntries()))
+	for _, e := range d.GetEntries() {
+		switch {
+		case slices.Contains(s.cfg.KeyEntries, e.GetKey()):
+			key = e.GetValue()
+		case e.GetKey() == "remote_address":
+			remote = e.GetValue()
+		case e.GetKey() == s.cfg.MethodEntry:
+			method = e.GetValue()
+		case e.GetKey() == s.cfg.PathEntry:
+			path = e.GetValue()
+		}
+		parts = append(parts, e.GetKey()+"="+e.GetValue())
+	}
+	descriptorKey := domain + ":" + strings.Join(parts, ",")
+
+	if limit := d.GetLimit(); limit != nil {
+		if refillRate, ok := refillRate(limit); ok {
+			return s.limiter.TakeLimit(ctx, "envoy:"+descriptorKey, int64(limit.GetRequestsPerUnit()), refillRate, cost)
+		}
+	}
+
+	addr, err := netip.ParseAddr(remote)
+	if err == nil {
+		addr = addr.Unmap()
+	}
+	if key == "" && addr.IsValid() {
+		key = addr.String()
+	}
+
+	if path != "" {
+		if rule, ok := s.rules.Match(ruleRequest(method, path)); ok {
+			if key == "" {
+				key = descriptorKey
+			}
+			return s.limiter.TakeRule(ctx, rule, key, cost)
+		}
+	}
+
+	switch {
+	case key != "" && key != addr.String():
+		return s.limiter.Take(ctx, key, cost)
+	case addr.IsValid():
+		return s.limiter.TakeAnonymous(ctx, addr, cost)
+	}
+	return s.limiter.Take(ctx, descriptorKey, cost)
+}
+
+func ruleRequest(method, path string) *http.Request {
+	if method == "" {
+		method = http.MethodGet
+	}
+	u, err := url.ParseRequestURI(path)
+	if err != nil {
+		u = &url.URL{Path: path}
+	}
+	return &http.Request{Method: method, URL: u, Header: http.Header{}}
+}
+
+func refillRate(limit *ratelimitv3.RateLimitDescriptor_RateLimitOverride) (time.Duration, bool) {
+	var unit time.Duration
+	switch limit.GetUnit() {
+	case typev3.RateLimitUnit_SECOND:
+		unit = time.Second
+	case typev3.RateLimitUnit_MINUTE:
+		unit = time.Minute
+	case typev3.RateLimitUnit_HOUR:
+		unit = time.Hour
+	case typev3.RateLimitUnit_DAY:
+		unit = 24 * time.Hour
+	case typev3.RateLimitUnit_MONTH:
+		unit = 30 * 24 * time.Hour
+	case typev3.RateLimitUnit_YEAR:
+		unit = 365 * 24 * time.Hour
+	default:
+		return 0, false
+	}
+	if limit.GetRequestsPerUnit() == 0 {
+		return 0, false
+	}
+	return unit / time.Duration(limit.GetRequestsPerUnit()), true
+}
+
+func descriptorStatus(res ratelimit.Result) *rlsv3.RateLimitResponse_DescriptorStatus {
+	st := &rlsv3.RateLimitResponse_DescriptorStatus{Code: rlsv3.RateLimitResponse_OK}
+	if !res.Allowed {
+		st.Code = rlsv3.RateLimitResponse_OVER_LIMIT
+	}
+	if res.Unlimited {
+		return st
+	}
+
+	st.CurrentLimit = currentLimit(res)
+	st.LimitRemaining = uint32(min(max(res.Remaining, 0), math.MaxUint32))
+	reset := res.ResetAfter
+	if !res.Allowed {
+		reset = res.RetryAfter
+	}
+	st.DurationUntilReset = durationpb.New(reset)
+	return st
+}
+
+// currentLimit expresses the refill rate of a bucket in the smallest unit
+// in which at least one token is added.
+func currentLimit(res ratelimit.Result) *rlsv3.RateLimitResponse_RateLimit {
+	if res.Limit <= 0 {
+		return nil
+	}
+	refillRate := max(res.Window/time.Duration(res.Limit), time.Nanosecond)
+
+	units := []struct {
+		unit     rlsv3.RateLimitResponse_RateLimit_Unit
+		duration time.Duration
+	}{
+		{rlsv3.RateLimitResponse_RateLimit_SECOND, time.Second},
+		{rlsv3.RateLimitResponse_RateLimit_MINUTE, time.Minute},
+		{rlsv3.RateLimitResponse_RateLimit_HOUR, time.Hour},
+		{rlsv3.RateLimitResponse_RateLimit_DAY, 24 * time.Hour},
+	}
+	for _, u := range units {
+		if refillRate <= u.duration {
+			return &rlsv3.RateLimitResponse_RateLimit{
+				Name:            fmt.Sprintf("%d tokens, one every %s", res.Limit, refillRate),
+				RequestsPerUnit: uint32(min(u.duration/refillRate, math.MaxUint32)),
+				Unit:            u.unit,
+			}
+		}
+	}
+	return &rlsv3.RateLimitResponse_RateLimit{
+		Name: fmt.Sprintf("%d tokens, one every %s", res.Limit, refillRate),
+		Unit: rlsv3.RateLimitResponse_RateLimit_DAY,
+	}
+}
@@ -0,0 +1,294 @@
+package envoy
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"ratelimiter/internal/models"
+	"ratelimiter/internal/rate_limiter"
+	"ratelimiter/internal/repositories"
+)
+
+// fakeDB knows no clients and the given rules.
+type fakeDB struct {
+	repositories.DBInterface
+	rules []repositories.Rule
+}
+
+func (fakeDB) GetClient(context.Context, string) (repositories.Client, error) {
+	return repositories.Client{}, pgx.ErrNoRows
+}
+
+func (db fakeDB) ListRules(context.Context) ([]repositories.Rule, error) {
+	return db.rules, nil
+}
+
+// newTestClient serves a Server over an in-process connection. Keys without
+// a client get two requests per hour.
+func newTestClient(t *testing.T, rules ...repositories.Rule) rlsv3.RateLimitServiceClient {
+	t.Helper()
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	db := fakeDB{rules: rules}
+	store := rate_limiter.NewBucketStore()
+	ruleSet := rate_limiter.NewRuleSet(log, db, store)
+	if err := ruleSet.Load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	lookup := rate_limiter.NewClientLookup(log, db, time.Minute, 100, 0)
+	limiter := rate_limiter.NewLimiter(store, models.Limit{Capacity: 2, RefillRate: 1800}, models.AnonymousLimits{}, lookup)
+	cfg := models.Envoy{KeyEntries: []string{"client_id"}, MethodEntry: "method", PathEntry: "path"}
+
+	lis := bufconn.Listen(1 << 20)
+	g := grpc.NewServer()
+	New(log, limiter, ruleSet, cfg, false).Register(g)
+	go g.Serve(lis)
+	t.Cleanup(g.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return rlsv3.NewRateLimitServiceClient(conn)
+}
+
+func descriptor(entries ...string) *ratelimitv3.RateLimitDescriptor {
+	d := &ratelimitv3.RateLimitDescriptor{}
+	for i := 0; i+1 < len(entries); i += 2 {
+		d.Entries = append(d.Entries, &ratelimitv3.RateLimitDescriptor_Entry{Key: entries[i], Value: entries[i+1]})
+	}
+	return d
+}
+
+func withLimit(d *ratelimitv3.RateLimitDescriptor, requestsPerUnit uint32, unit typev3.RateLimitUnit) *ratelimitv3.RateLimitDescriptor {
+	d.Limit = &ratelimitv3.RateLimitDescriptor_RateLimitOverride{RequestsPerUnit: requestsPerUnit, Unit: unit}
+	return d
+}
+
+func shouldRateLimit(t *testing.T, client rlsv3.RateLimitServiceClient, req *rlsv3.RateLimitRequest) *rlsv3.RateLimitResponse {
+	t.Helper()
+	resp, err := client.ShouldRateLimit(context.Background(), req)
+	if err != nil {
+		t.Fatalf("ShouldRateLimit() error = %v", err)
+	}
+	return resp
+}
+
+func statusCodes(resp *rlsv3.RateLimitResponse) []rlsv3.RateLimitResponse_Code {
+	var c []rlsv3.RateLimitResponse_Code
+	for _, st := range resp.GetStatuses() {
+		c = append(c, st.GetCode())
+	}
+	return c
+}
+
+func TestShouldRateLimitValidates(t *testing.T) {
+	client := newTestClient(t)
+
+	tests := []struct {
+		name string
+		req  *rlsv3.RateLimitRequest
+	}{
+		{name: "no domain", req: &rlsv3.RateLimitRequest{Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor("client_id", "acme")}}},
+		{name: "no descriptors", req: &rlsv3.RateLimitRequest{Domain: "edge"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := client.ShouldRateLimit(context.Background(), tt.req)
+			if status.Code(err) != codes.InvalidArgument {
+				t.Errorf("ShouldRateLimit() error = %v, want InvalidArgument", err)
+			}
+		})
+	}
+}
+
+func TestShouldRateLimitClientKey(t *testing.T) {
+	client := newTestClient(t)
+	req := &rlsv3.RateLimitRequest{Domain: "edge", Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor("client_id", "acme")}}
+
+	for i, want := range []rlsv3.RateLimitResponse_Code{
+		rlsv3.RateLimitResponse_OK,
+		rlsv3.RateLimitResponse_OK,
+		rlsv3.RateLimitResponse_OVER_LIMIT,
+	} {
+		resp := shouldRateLimit(t, client, req)
+		if resp.GetOverallCode() != want {
+			t.Fatalf("request %d: code = %v, want %v", i+1, resp.GetOverallCode(), want)
+		}
+	}
+
+	other := &rlsv3.RateLimitRequest{Domain: "edge", Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor("client_id", "globex")}}
+	if resp := shouldRateLimit(t, client, other); resp.GetOverallCode() != rlsv3.RateLimitResponse_OK {
+		t.Errorf("other client: code = %v, want OK", resp.GetOverallCode())
+	}
+}
+
+func TestShouldRateLimitHeaders(t *testing.T) {
+	client := newTestClient(t)
+	resp := shouldRateLimit(t, client, &rlsv3.RateLimitRequest{
+		Domain:      "edge",
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor("client_id", "acme")},
+	})
+
+	headers := make(map[string]string)
+	for _, h := range resp.GetResponseHeadersToAdd() {
+		headers[h.GetKey()] = h.GetValue()
+	}
+	if headers["Ratelimit-Limit"] != "2" || headers["Ratelimit-Remaining"] != "1" {
+		t.Errorf("headers = %v, want a limit of 2 with 1 remaining", headers)
+	}
+
+	st := resp.GetStatuses()[0]
+	if st.GetLimitRemaining() != 1 || st.GetCurrentLimit() == nil {
+		t.Errorf("status = %v, want 1 remaining and the current limit", st)
+	}
+}
+
+func TestShouldRateLimitHitsAddend(t *testing.T) {
+	client := newTestClient(t)
+
+	d := descriptor("client_id", "acme")
+	d.HitsAddend = wrapperspb.UInt64(3)
+	resp := shouldRateLimit(t, client, &rlsv3.RateLimitRequest{Domain: "edge", Descriptors: []*ratelimitv3.RateLimitDescriptor{d}})
+	if resp.GetOverallCode() != rlsv3.RateLimitResponse_OVER_LIMIT {
+		t.Errorf("descriptor hits_addend over capacity: code = %v, want OVER_LIMIT", resp.GetOverallCode())
+	}
+
+	resp = shouldRateLimit(t, client, &rlsv3.RateLimitRequest{
+		Domain:      "edge",
+		HitsAddend:  2,
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor("client_id", "acme")},
+	})
+	if resp.GetOverallCode() != rlsv3.RateLimitResponse_OK || resp.GetStatuses()[0].GetLimitRemaining() != 0 {
+		t.Errorf("request hits_addend: %v, want OK with nothing remaining", resp)
+	}
+}
+
+func TestShouldRateLimitOverride(t *testing.T) {
+	client := newTestClient(t)
+	req := func(requestsPerUnit uint32) *rlsv3.RateLimitRequest {
+		return &rlsv3.RateLimitRequest{
+			Domain:      "edge",
+			Descriptors: []*ratelimitv3.RateLimitDescriptor{withLimit(descriptor("tenant", "acme"), requestsPerUnit, typev3.RateLimitUnit_MINUTE)},
+		}
+	}
+
+	resp := shouldRateLimit(t, client, req(10))
+	st := resp.GetStatuses()[0]
+	if st.GetCode() != rlsv3.RateLimitResponse_OK || st.GetLimitRemaining() != 9 {
+		t.Fatalf("first request: %v, want OK with 9 remaining", st)
+	}
+	if got := st.GetCurrentLimit().GetRequestsPerUnit(); got != 10 {
+		t.Errorf("current limit = %d per minute, want 10", got)
+	}
+
+	// the new limit applies to the same bucket, which keeps its tokens up
+	// to the new capacity
+	resp = shouldRateLimit(t, client, req(2))
+	st = resp.GetStatuses()[0]
+	if st.GetCode() != rlsv3.RateLimitResponse_OK || st.GetLimitRemaining() != 1 {
+		t.Fatalf("after lowering the limit: %v, want OK with 1 remaining", st)
+	}
+	if got := st.GetCurrentLimit().GetRequestsPerUnit(); got != 2 {
+		t.Errorf("current limit = %d per minute, want 2", got)
+	}
+
+	shouldRateLimit(t, client, req(2))
+	if resp := shouldRateLimit(t, client, req(2)); resp.GetOverallCode() != rlsv3.RateLimitResponse_OVER_LIMIT {
+		t.Errorf("over the lowered limit: code = %v, want OVER_LIMIT", resp.GetOverallCode())
+	}
+}
+
+func TestShouldRateLimitRule(t *testing.T) {
+	client := newTestClient(t, repositories.Rule{
+		ID:         1,
+		Pattern:    "POST /login",
+		Capacity:   1,
+		RefillRate: time.Hour,
+		Scope:      repositories.ScopeClient,
+	})
+	req := func(clientID, method string) *rlsv3.RateLimitRequest {
+		return &rlsv3.RateLimitRequest{
+			Domain:      "edge",
+			Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor("client_id", clientID, "method", method, "path", "/login")},
+		}
+	}
+
+	if resp := shouldRateLimit(t, client, req("acme", "POST")); resp.GetOverallCode() != rlsv3.RateLimitResponse_OK {
+		t.Fatalf("first login: code = %v, want OK", resp.GetOverallCode())
+	}
+	if resp := shouldRateLimit(t, client, req("acme", "POST")); resp.GetOverallCode() != rlsv3.RateLimitResponse_OVER_LIMIT {
+		t.Errorf("second login: code = %v, want OVER_LIMIT", resp.GetOverallCode())
+	}
+	if resp := shouldRateLimit(t, client, req("globex", "POST")); resp.GetOverallCode() != rlsv3.RateLimitResponse_OK {
+		t.Errorf("login of another client: code = %v, want OK", resp.GetOverallCode())
+	}
+	// GET /login does not match the rule and counts against the client
+	if resp := shouldRateLimit(t, client, req("acme", "GET")); resp.GetOverallCode() != rlsv3.RateLimitResponse_OK {
+		t.Errorf("GET /login: code = %v, want OK", resp.GetOverallCode())
+	}
+}
+
+func TestShouldRateLimitSeveralDescriptors(t *testing.T) {
+	client := newTestClient(t)
+	req := &rlsv3.RateLimitRequest{
+		Domain: "edge",
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{
+			descriptor("client_id", "acme"),
+			withLimit(descriptor("tenant", "acme"), 1, typev3.RateLimitUnit_HOUR),
+		},
+	}
+
+	resp := shouldRateLimit(t, client, req)
+	if resp.GetOverallCode() != rlsv3.RateLimitResponse_OK {
+		t.Fatalf("first request: code = %v, want OK", resp.GetOverallCode())
+	}
+
+	resp = shouldRateLimit(t, client, req)
+	want := []rlsv3.RateLimitResponse_Code{rlsv3.RateLimitResponse_OK, rlsv3.RateLimitResponse_OVER_LIMIT}
+	if got := statusCodes(resp); len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("statuses = %v, want %v", got, want)
+	}
+	if resp.GetOverallCode() != rlsv3.RateLimitResponse_OVER_LIMIT {
+		t.Errorf("overall code = %v, want OVER_LIMIT", resp.GetOverallCode())
+	}
+}
+
+func TestShouldRateLimitRemoteAddress(t *testing.T) {
+	client := newTestClient(t)
+	req := func(addr string) *rlsv3.RateLimitRequest {
+		return &rlsv3.RateLimitRequest{Domain: "edge", Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor("remote_address", addr)}}
+	}
+
+	shouldRateLimit(t, client, req("192.0.2.1"))
+	// the mapped form is the same client
+	shouldRateLimit(t, client, req("::ffff:192.0.2.1"))
+	if resp := shouldRateLimit(t, client, req("192.0.2.1")); resp.GetOverallCode() != rlsv3.RateLimitResponse_OVER_LIMIT {
+		t.Errorf("third request: code = %v, want OVER_LIMIT", resp.GetOverallCode())
+	}
+	if resp := shouldRateLimit(t, client, req("192.0.2.2")); resp.GetOverallCode() != rlsv3.RateLimitResponse_OK {
+		t.Errorf("other address: code = %v, want OK", resp.GetOverallCode())
+	}
+}
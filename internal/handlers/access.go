@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"ratelimiter/internal/rate_limiter"
+	"ratelimiter/internal/repositories"
+	apperrors "ratelimiter/pkg/errors"
+	"ratelimiter/pkg/ratelimit"
+)
+
+type AccessEntryRequest struct {
+	CIDR             string    `json:"cidr"`
+	Key              string    `json:"key"`
+	Comment          string    `json:"comment"`
+	ExpiresInSeconds int       `json:"expires_in_seconds"`
+	ExpiresAt        time.Time `json:"expires_at"`
+}
+
+type AccessEntryResponse struct {
+	ID        int64      `json:"id"`
+	List      string     `json:"list"`
+	CIDR      string     `json:"cidr,omitempty"`
+	Key       string     `json:"key,omitempty"`
+	Comment   string     `json:"comment"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+func AddAccessEntryHandler(log *slog.Logger, db repositories.DBInterface, lists *rate_limiter.AccessLists, list string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Debug("Adding access entry handler", "list", list)
+		log.Info("Start adding access entry")
+
+		var req AccessEntryRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Error("Failed to decode request body", "error", err)
+			sendError(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		entry := repositories.AccessEntry{
+			List:       list,
+			KeyPattern: req.Key,
+			Comment:    req.Comment,
+			ExpiresAt:  req.ExpiresAt,
+			CreatedAt:  time.Now(),
+		}
+
+		switch {
+		case (req.CIDR == "") == (req.Key == ""):
+			sendError(w, "exactly one of cidr and key is required", http.StatusBadRequest)
+			return
+		case req.ExpiresInSeconds < 0:
+			sendError(w, "expires_in_seconds must not be negative", http.StatusBadRequest)
+			return
+		case req.ExpiresInSeconds > 0 && !req.ExpiresAt.IsZero():
+			sendError(w, "only one of expires_in_seconds and expires_at may be set", http.StatusBadRequest)
+			return
+		}
+
+		if req.CIDR != "" {
+			prefix, err := ratelimit.ParsePrefix(req.CIDR)
+			if err != nil {
+				sendError(w, "invalid cidr: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			entry.CIDR = prefix
+		}
+		if req.ExpiresInSeconds > 0 {
+			entry.ExpiresAt = entry.CreatedAt.Add(time.Duration(req.ExpiresInSeconds) * time.Second)
+		}
+		if !entry.ExpiresAt.IsZero() && !entry.ExpiresAt.After(entry.CreatedAt) {
+			sendError(w, "expires_at must be in the future", http.StatusBadRequest)
+			return
+		}
+
+		entry, err := db.AddAccessEntry(r.Context(), entry)
+		if err != nil {
+			log.Error("Failed to add access entry", "error", err)
+			sendError(w, "failed to add access entry", http.StatusInternalServerError)
+			return
+		}
+
+		if err := lists.Load(r.Context()); err != nil {
+			log.Error("Failed to reload access lists", "error", err)
+		}
+
+		writeJSON(log, w, http.StatusCreated, newAccessEntryResponse(entry))
+
+		log.Info("End adding access entry")
+	}
+}
+
+func ListAccessEntriesHandler(log *slog.Logger, db repositories.DBInterface, list string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Debug("Listing access entries handler", "list", list)
+
+		entries, err := db.ListAccessEntries(r.Context())
+		if err != nil {
+			log.Error("Failed to list access entries", "error", err)
+			sendError(w, "failed to list access entries", http.StatusInternalServerError)
+			return
+		}
+
+		response := make([]AccessEntryResponse, 0, len(entries))
+		for _, entry := range entries {
+			if entry.List == list {
+				response = append(response, newAccessEntryResponse(entry))
+			}
+		}
+
+		writeJSON(log, w, http.StatusOK, response)
+	}
+}
+
+func DeleteAccessEntryHandler(log *slog.Logger, db repositories.DBInterface, lists *rate_limiter.AccessLists, list string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Debug("Deleting access entry handler", "list", list)
+		log.Info("Start deleting access entry")
+
+		id, err := strconv.ParseInt(r.PathValue("entryID"), 10, 64)
+		if err != nil {
+			sendError(w, "invalid entry id", http.StatusBadRequest)
+			return
+		}
+
+		err = db.DeleteAccessEntry(r.Context(), list, id)
+		if errors.Is(err, apperrors.ErrNotFound) {
+			sendError(w, "entry not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Error("Failed to delete access entry", "error", err)
+			sendError(w, "failed to delete access entry", http.StatusInternalServerError)
+			return
+		}
+
+		if err := lists.Load(r.Context()); err != nil {
+			log.Error("Failed to reload access lists", "error", err)
+		}
+
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write([]byte("Entry deleted successfully\n")); err != nil {
+			log.Error("Error writing response", "error", err)
+		}
+
+		log.Info("End deleting access entry")
+	}
+}
+
+func newAccessEntryResponse(entry repositories.AccessEntry) AccessEntryResponse {
+	resp := AccessEntryResponse{
+		ID:        entry.ID,
+		List:      entry.List,
+		Key:       entry.KeyPattern,
+		Comment:   entry.Comment,
+		CreatedAt: entry.CreatedAt,
+	}
+	if entry.CIDR.IsValid() {
+		resp.CIDR = entry.CIDR.String()
+	}
+	if !entry.ExpiresAt.IsZero() {
+		resp.ExpiresAt = &entry.ExpiresAt
+	}
+	return resp
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"ratelimiter/internal/rate_limiter"
+	"ratelimiter/internal/repositories"
+	apperrors "ratelimiter/pkg/errors"
+)
+
+func ListBansHandler(log *slog.Logger, db repositories.DBInterface) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Debug("Listing bans handler")
+
+		bans, err := db.ListBans(r.Context())
+		if err != nil {
+			log.Error("Failed to list bans", "error", err)
+			sendError(w, "failed to list bans", http.StatusInternalServerError)
+			return
+		}
+		if bans == nil {
+			bans = []repositories.Ban{}
+		}
+
+		writeJSON(log, w, http.StatusOK, bans)
+	}
+}
+
+func GetBanHandler(log *slog.Logger, db repositories.DBInterface) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Debug("Getting ban handler")
+
+		ban, err := db.GetBan(r.Context(), r.PathValue("key"))
+		if errors.Is(err, apperrors.ErrNotFound) {
+			sendError(w, "ban not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Error("Failed to get ban", "error", err)
+			sendError(w, "failed to get ban", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(log, w, http.StatusOK, ban)
+	}
+}
+
+func LiftBanHandler(log *slog.Logger, bans *rate_limiter.Bans) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Debug("Lifting ban handler")
+		log.Info("Start lifting ban")
+
+		err := bans.Lift(r.Context(), r.PathValue("key"))
+		if errors.Is(err, apperrors.ErrNotFound) {
+			sendError(w, "ban not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Error("Failed to lift ban", "error", err)
+			sendError(w, "failed to lift ban", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write([]byte("Ban lifted successfully\n")); err != nil {
+			log.Error("Error writing response", "error", err)
+		}
+
+		log.Info("End lifting ban")
+	}
+}
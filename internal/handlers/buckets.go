@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"ratelimiter/internal/rate_limiter"
+)
+
+const defaultBucketsLimit = 50
+
+type BucketResponse struct {
+	Key         string    `json:"key"`
+	Tokens      int64     `json:"tokens"`
+	Capacity    int64     `json:"capacity"`
+	RefillRate  float64   `json:"refill_rate_seconds"`
+	LastRefill  time.Time `json:"last_refill"`
+	NextTokenIn float64   `json:"next_token_in_seconds"`
+	Share       float64   `json:"share"`
+	Unlimited   bool      `json:"unlimited"`
+	Default     bool      `json:"default"`
+	// Mode is the mode of the limit, and ShadowRejections the requests it
+	// would have rejected in shadow mode.
+	Mode             string `json:"mode"`
+	ShadowRejections int64  `json:"shadow_rejections"`
+}
+
+type ResetBucketRequest struct {
+	Mode string `json:"mode"`
+}
+
+func GetBucketHandler(log *slog.Logger, store *rate_limiter.BucketStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Debug("Getting bucket handler")
+
+		key := r.PathValue("clientID")
+		if key == "" {
+			sendError(w, "missing client id", http.StatusBadRequest)
+			return
+		}
+
+		bucket := store.Get(rate_limiter.ClientBucketKey(key))
+		if bucket == nil {
+			sendError(w, "no bucket for the given key", http.StatusNotFound)
+			return
+		}
+
+		writeJSON(log, w, http.StatusOK, newBucketResponse(key, bucket.State()))
+	}
+}
+
+func ResetBucketHandler(log *slog.Logger, store *rate_limiter.BucketStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Debug("Resetting bucket handler")
+		log.Info("Start resetting bucket")
+
+		key := r.PathValue("clientID")
+		if key == "" {
+			sendError(w, "missing client id", http.StatusBadRequest)
+			return
+		}
+
+		var req ResetBucketRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			log.Error("Failed to decode request body", "error", err)
+			sendError(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		var drain bool
+		switch req.Mode {
+		case "", "refill":
+		case "drain":
+			drain = true
+		default:
+			sendError(w, "mode must be refill or drain", http.StatusBadRequest)
+			return
+		}
+
+		bucket := store.Get(rate_limiter.ClientBucketKey(key))
+		if bucket == nil {
+			sendError(w, "no bucket for the given key", http.StatusNotFound)
+			return
+		}
+
+		writeJSON(log, w, http.StatusOK, newBucketResponse(key, bucket.Reset(drain)))
+
+		log.Info("End resetting bucket", "key", key, "drain", drain)
+	}
+}
+
+func ListBucketsHandler(log *slog.Logger, store *rate_limiter.BucketStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Debug("Listing buckets handler")
+
+		limit := defaultBucketsLimit
+		if s := r.URL.Query().Get("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				sendError(w, "limit must be a positive integer", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		states := store.States()
+		switch sort := r.URL.Query().Get("sort"); sort {
+		case "", "depleted":
+			slices.SortFunc(states, func(a, b rate_limiter.KeyedBucketState) int {
+				return compareFill(a.BucketState, b.BucketState)
+			})
+		case "tokens":
+			slices.SortFunc(states, func(a, b rate_limiter.KeyedBucketState) int {
+				return cmp.Compare(a.Tokens, b.Tokens)
+			})
+		case "key":
+			slices.SortFunc(states, func(a, b rate_limiter.KeyedBucketState) int {
+				return strings.Compare(a.Key, b.Key)
+			})
+		default:
+			sendError(w, "sort must be one of depleted, tokens, key", http.StatusBadRequest)
+			return
+		}
+
+		response := make([]BucketResponse, 0, min(limit, len(states)))
+		for _, s := range states[:min(limit, len(states))] {
+			response = append(response, newBucketResponse(s.Key, s.BucketState))
+		}
+
+		writeJSON(log, w, http.StatusOK, response)
+	}
+}
+
+func newBucketResponse(key string, state rate_limiter.BucketState) BucketResponse {
+	return BucketResponse{
+		Key:         key,
+		Tokens:      state.Tokens,
+		Capacity:    state.Capacity,
+		RefillRate:  state.RefillRate.Seconds(),
+		LastRefill:  state.LastRefill,
+		NextTokenIn: state.NextTokenIn.Seconds(),
+		Share:       state.Share,
+		Unlimited:   state.Unlimited,
+		Default:     state.Fallback,
+
+		Mode:             state.Mode,
+		ShadowRejections: state.ShadowRejections,
+	}
+}
+
+// compareFill orders buckets from the most to the least depleted one.
+func compareFill(a, b rate_limiter.BucketState) int {
+	return cmp.Compare(fill(a), fill(b))
+}
+
+func fill(s rate_limiter.BucketState) float64 {
+	if s.Unlimited {
+		return 2
+	}
+	if s.Capacity <= 0 {
+		return 0
+	}
+	return float64(s.Tokens) / float64(s.Capacity)
+}
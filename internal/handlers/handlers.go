@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"net/http"
 	"time"
@@ -8,26 +9,44 @@ import (
 	"ratelimiter/internal/rate_limiter"
 	"ratelimiter/internal/repositories"
 	"ratelimiter/pkg/errors"
+	"ratelimiter/pkg/ratelimit"
 
 	"log/slog"
 )
 
 type AddClientRequest struct {
-	ClientID   string `json:"client_id"`
-	Capacity   int64  `json:"capacity"`
-	RefillRate int    `json:"refill_rate_seconds"`
-	Unlimited  bool   `json:"unlimited"`
+	ClientID       string `json:"client_id"`
+	Capacity       int64  `json:"capacity"`
+	RefillRate     int    `json:"refill_rate_seconds"`
+	Unlimited      bool   `json:"unlimited"`
+	Mode           string `json:"mode"`
+	MaxBodyBytes   int64  `json:"max_body_bytes"`
+	MaxHeaderCount int    `json:"max_header_count"`
+	MaxHeaderBytes int64  `json:"max_header_bytes"`
 }
 
 type GetClientResponse struct {
-	ClientID   string `json:"client_id"`
-	Capacity   int64  `json:"capacity"`
-	RefillRate int    `json:"refill_rate_seconds"`
-	Unlimited  bool   `json:"unlimited"`
+	ClientID       string `json:"client_id"`
+	Capacity       int64  `json:"capacity"`
+	RefillRate     int    `json:"refill_rate_seconds"`
+	Unlimited      bool   `json:"unlimited"`
+	Mode           string `json:"mode"`
+	MaxBodyBytes   int64  `json:"max_body_bytes"`
+	MaxHeaderCount int    `json:"max_header_count"`
+	MaxHeaderBytes int64  `json:"max_header_bytes"`
 }
 
-type ErrorResponse struct {
-	Error string `json:"error"`
+func newClientResponse(c repositories.Client) GetClientResponse {
+	return GetClientResponse{
+		ClientID:       c.Key,
+		Capacity:       c.Capacity,
+		RefillRate:     int(c.RefillRate.Seconds()),
+		Unlimited:      c.Unlimited,
+		Mode:           c.Mode,
+		MaxBodyBytes:   c.MaxBodyBytes,
+		MaxHeaderCount: c.MaxHeaderCount,
+		MaxHeaderBytes: c.MaxHeaderBytes,
+	}
 }
 
 func AddClientHandler(log *slog.Logger, db repositories.DBInterface, store *rate_limiter.BucketStore) http.HandlerFunc {
@@ -38,7 +57,7 @@ func AddClientHandler(log *slog.Logger, db repositories.DBInterface, store *rate
 		var req AddClientRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			log.Error("Failed to decode request body", "error", err)
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			sendError(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
 
@@ -46,26 +65,34 @@ func AddClientHandler(log *slog.Logger, db repositories.DBInterface, store *rate
 			sendError(w, "client_id is required", http.StatusBadRequest)
 			return
 		}
+		if !validMode(req.Mode) {
+			sendError(w, "mode must be enforce, shadow or off", http.StatusBadRequest)
+			return
+		}
+		if req.MaxBodyBytes < 0 || req.MaxHeaderCount < 0 || req.MaxHeaderBytes < 0 {
+			sendError(w, errNegativeSizeLimit, http.StatusBadRequest)
+			return
+		}
 
 		client := repositories.Client{
-			Key:        req.ClientID,
-			Capacity:   req.Capacity,
-			RefillRate: time.Duration(req.RefillRate) * time.Second,
-			Unlimited:  req.Unlimited,
-			CreatedAt:  time.Now(),
+			Key:            req.ClientID,
+			Capacity:       req.Capacity,
+			RefillRate:     time.Duration(req.RefillRate) * time.Second,
+			Unlimited:      req.Unlimited,
+			Mode:           req.Mode,
+			MaxBodyBytes:   req.MaxBodyBytes,
+			MaxHeaderCount: req.MaxHeaderCount,
+			MaxHeaderBytes: req.MaxHeaderBytes,
+			CreatedAt:      time.Now(),
 		}
 
 		if err := db.AddClient(r.Context(), client); err != nil {
 			log.Error("Failed to add client", "error", err)
-			http.Error(w, "Failed to add client", http.StatusInternalServerError)
+			sendError(w, "Failed to add client", http.StatusInternalServerError)
 			return
 		}
 
-		store.Set(client.Key, rate_limiter.NewTokenBucket(
-			client.Capacity,
-			client.RefillRate,
-			client.Unlimited,
-		))
+		store.Set(rate_limiter.ClientBucketKey(client.Key), rate_limiter.NewClientBucket(client))
 
 		w.WriteHeader(http.StatusCreated)
 		_, err := w.Write([]byte("Client was added successfully\n"))
@@ -85,32 +112,27 @@ func ListClientsHandler(log *slog.Logger, db repositories.DBInterface) http.Hand
 		clients, err := db.ListClients(r.Context())
 		if err != nil {
 			log.Error("Failed to list clients", "error", err)
-			http.Error(w, "Failed to list clients", http.StatusInternalServerError)
+			sendError(w, "Failed to list clients", http.StatusInternalServerError)
 			return
 		}
 
 		response := make([]GetClientResponse, 0, len(clients))
 		for _, c := range clients {
-			response = append(response, GetClientResponse{
-				ClientID:   c.Key,
-				Capacity:   c.Capacity,
-				RefillRate: int(c.RefillRate.Seconds()),
-				Unlimited:  c.Unlimited,
-			})
+			response = append(response, newClientResponse(c))
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		jsonData, err := json.MarshalIndent(response, "", "    ")
 		if err != nil {
 			log.Error("Error marshaling response", "error", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			sendError(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
 
 		_, err = w.Write(jsonData)
 		if err != nil {
 			log.Error("Error writing response", "error", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			sendError(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
 
@@ -132,21 +154,16 @@ func GetClientHandler(log *slog.Logger, db repositories.DBInterface) http.Handle
 		client, err := db.GetClient(r.Context(), key)
 		if err != nil {
 			log.Error("Failed to get client", "error", err)
-			http.Error(w, "Client not found", http.StatusNotFound)
+			sendError(w, "Client not found", http.StatusNotFound)
 			return
 		}
 
-		response := GetClientResponse{
-			ClientID:   client.Key,
-			Capacity:   client.Capacity,
-			RefillRate: int(client.RefillRate.Seconds()),
-			Unlimited:  client.Unlimited,
-		}
+		response := newClientResponse(client)
 
 		w.Header().Set("Content-Type", "application/json")
 		if err := json.NewEncoder(w).Encode(response); err != nil {
 			log.Error("Error encoding response", "error", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			sendError(w, "Internal server error", http.StatusInternalServerError)
 		}
 
 		log.Info("End getting client")
@@ -154,12 +171,31 @@ func GetClientHandler(log *slog.Logger, db repositories.DBInterface) http.Handle
 }
 
 type UpdateClientRequest struct {
-	Capacity   int64 `json:"capacity"`
-	RefillRate int   `json:"refill_rate_seconds"`
-	Unlimited  *bool `json:"unlimited"`
+	Capacity   int64  `json:"capacity"`
+	RefillRate int    `json:"refill_rate_seconds"`
+	Unlimited  *bool  `json:"unlimited"`
+	Mode       string `json:"mode"`
+	// the size limits are kept if null, zero removes them
+	MaxBodyBytes   *int64 `json:"max_body_bytes"`
+	MaxHeaderCount *int   `json:"max_header_count"`
+	MaxHeaderBytes *int64 `json:"max_header_bytes"`
+	// Tokens is what happens to the tokens of the live bucket: preserve
+	// (the default) keeps them up to the new capacity, scale keeps the
+	// bucket as full as it was and reset fills it.
+	Tokens string `json:"tokens"`
+}
+
+// UpdateClientResponse reports the bucket of the client before and after
+// the change. Before is null if the client had no bucket yet.
+type UpdateClientResponse struct {
+	Client GetClientResponse `json:"client"`
+	Before *BucketResponse   `json:"before"`
+	After  BucketResponse    `json:"after"`
 }
 
-func EditClientHandler(log *slog.Logger, db repositories.DBInterface) http.HandlerFunc {
+// EditClientHandler applies the edit to the bucket of this instance, origin,
+// which the change notification then skips.
+func EditClientHandler(log *slog.Logger, db repositories.DBInterface, store *rate_limiter.BucketStore, origin string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Debug("Editing client handler")
 		log.Info("Start editing client")
@@ -173,14 +209,14 @@ func EditClientHandler(log *slog.Logger, db repositories.DBInterface) http.Handl
 		var req UpdateClientRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			log.Error("failed to decode request body", "error", err)
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			sendError(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
 
 		existingClient, err := db.GetClient(r.Context(), key)
 		if err != nil {
 			log.Error("client not found", "key", key, "error", err)
-			http.Error(w, "Client not found", http.StatusNotFound)
+			sendError(w, "Client not found", http.StatusNotFound)
 			return
 		}
 
@@ -193,24 +229,60 @@ func EditClientHandler(log *slog.Logger, db repositories.DBInterface) http.Handl
 		if req.Unlimited != nil {
 			existingClient.Unlimited = *req.Unlimited
 		}
+		if req.Mode != "" {
+			if !validMode(req.Mode) {
+				sendError(w, "mode must be enforce, shadow or off", http.StatusBadRequest)
+				return
+			}
+			existingClient.Mode = req.Mode
+		}
+		if req.MaxBodyBytes != nil {
+			existingClient.MaxBodyBytes = *req.MaxBodyBytes
+		}
+		if req.MaxHeaderCount != nil {
+			existingClient.MaxHeaderCount = *req.MaxHeaderCount
+		}
+		if req.MaxHeaderBytes != nil {
+			existingClient.MaxHeaderBytes = *req.MaxHeaderBytes
+		}
+		if existingClient.MaxBodyBytes < 0 || existingClient.MaxHeaderCount < 0 || existingClient.MaxHeaderBytes < 0 {
+			sendError(w, errNegativeSizeLimit, http.StatusBadRequest)
+			return
+		}
+
+		policy := ratelimit.TokenPolicy(req.Tokens)
+		switch policy {
+		case "":
+			policy = ratelimit.PreserveTokens
+		case ratelimit.PreserveTokens, ratelimit.ScaleTokens, ratelimit.ResetTokens:
+		default:
+			sendError(w, "tokens must be preserve, scale or reset", http.StatusBadRequest)
+			return
+		}
 
-		err = db.UpdateClient(r.Context(), existingClient)
+		err = db.UpdateClient(r.Context(), existingClient, origin, string(policy))
 		if err != nil {
 			if err == errors.ErrNotFound {
 				log.Error("no client with the given key", "key", key, "error", err)
-				http.Error(w, "No client with the given key", http.StatusNotFound)
+				sendError(w, "No client with the given key", http.StatusNotFound)
 				return
 			}
 			log.Error("failed to update client", "error", err)
-			http.Error(w, "Failed to update client", http.StatusInternalServerError)
+			sendError(w, "Failed to update client", http.StatusInternalServerError)
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
-		_, err = w.Write([]byte("Client was updated successfully\n"))
-		if err != nil {
-			log.Error("Error writing response", "error", err)
+		before, after := store.Update(existingClient, policy)
+
+		response := UpdateClientResponse{
+			Client: newClientResponse(existingClient),
+			After:  newBucketResponse(existingClient.Key, after),
+		}
+		if before != nil {
+			b := newBucketResponse(existingClient.Key, *before)
+			response.Before = &b
 		}
+		writeJSON(log, w, http.StatusOK, response)
 
 		log.Info("End editing client")
 	}
@@ -229,11 +301,11 @@ func DeleteClientHandler(log *slog.Logger, db repositories.DBInterface, store *r
 
 		if err := db.DeleteClient(r.Context(), key); err != nil {
 			log.Error("Failed to delete client", "error", err)
-			http.Error(w, "Failed to delete client", http.StatusInternalServerError)
+			sendError(w, "Failed to delete client", http.StatusInternalServerError)
 			return
 		}
 
-		store.Delete(key)
+		store.Delete(rate_limiter.ClientBucketKey(key))
 
 		w.WriteHeader(http.StatusOK)
 		_, err := w.Write([]byte("Client deleted successfully\n"))
@@ -245,8 +317,58 @@ func DeleteClientHandler(log *slog.Logger, db repositories.DBInterface, store *r
 	}
 }
 
+func PeerAllowHandler(log *slog.Logger, store *rate_limiter.BucketStore, secret string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Debug("Peer allow handler")
+
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(rate_limiter.PeerSecretHeader)), []byte(secret)) != 1 {
+			log.Warn("Rejecting peer request without a valid secret", "remote_addr", r.RemoteAddr)
+			sendError(w, "invalid peer secret", http.StatusUnauthorized)
+			return
+		}
+
+		var req rate_limiter.PeerAllowRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Error("Failed to decode peer request body", "error", err)
+			sendError(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if req.Key == "" {
+			sendError(w, "key is required", http.StatusBadRequest)
+			return
+		}
+
+		res, ok := store.TakeLocal(r.Context(), req.Key, req.Cost)
+		if !ok {
+			sendError(w, "no limit for the given key", http.StatusNotFound)
+			return
+		}
+
+		writeJSON(log, w, http.StatusOK, res)
+	}
+}
+
+const errNegativeSizeLimit = "max_body_bytes, max_header_count and max_header_bytes must not be negative"
+
+// validMode accepts the limit modes, and an empty one for the default.
+func validMode(mode string) bool {
+	switch mode {
+	case "", repositories.ModeEnforce, repositories.ModeShadow, repositories.ModeOff:
+		return true
+	}
+	return false
+}
+
+// sendError writes an RFC 9457 problem with msg as the detail.
 func sendError(w http.ResponseWriter, msg string, code int) {
+	ratelimit.WriteProblem(w, ratelimit.NewProblem(code, msg))
+}
+
+func writeJSON(log *slog.Logger, w http.ResponseWriter, code int, v any) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
-	json.NewEncoder(w).Encode(ErrorResponse{Error: msg})
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error("Error encoding response", "error", err)
+	}
 }
@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"ratelimiter/pkg/ratelimit"
+)
+
+const defaultQueuesLimit = 50
+
+func ListQueuesHandler(log *slog.Logger, queue *ratelimit.FairQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Debug("Listing queues handler")
+
+		limit := defaultQueuesLimit
+		if s := r.URL.Query().Get("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				sendError(w, "limit must be a positive integer", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		stats := queue.Stats()
+		if stats == nil {
+			stats = []ratelimit.QueueStats{}
+		}
+
+		writeJSON(log, w, http.StatusOK, stats[:min(limit, len(stats))])
+	}
+}
@@ -0,0 +1,261 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"ratelimiter/internal/rate_limiter"
+	"ratelimiter/internal/repositories"
+	apperrors "ratelimiter/pkg/errors"
+)
+
+type RuleRequest struct {
+	Pattern    string `json:"pattern"`
+	Capacity   int64  `json:"capacity"`
+	RefillRate int    `json:"refill_rate_seconds"`
+	Scope      string `json:"scope"`
+	Mode       string `json:"mode"`
+}
+
+type RuleResponse struct {
+	ID         int64  `json:"id"`
+	Pattern    string `json:"pattern"`
+	Capacity   int64  `json:"capacity"`
+	RefillRate int    `json:"refill_rate_seconds"`
+	Scope      string `json:"scope"`
+	Mode       string `json:"mode"`
+}
+
+func AddRuleHandler(log *slog.Logger, db repositories.DBInterface, rules *rate_limiter.RuleSet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Debug("Adding rule handler")
+		log.Info("Start adding rule")
+
+		var req RuleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Error("Failed to decode request body", "error", err)
+			sendError(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if req.Scope == "" {
+			req.Scope = repositories.ScopeClient
+		}
+		if req.Mode == "" {
+			req.Mode = repositories.ModeEnforce
+		}
+
+		rule := repositories.Rule{
+			Pattern:    req.Pattern,
+			Capacity:   req.Capacity,
+			RefillRate: time.Duration(req.RefillRate) * time.Second,
+			Scope:      req.Scope,
+			Mode:       req.Mode,
+			CreatedAt:  time.Now(),
+		}
+		if msg := validateRule(rules, rule); msg != "" {
+			sendError(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		rule, err := db.AddRule(r.Context(), rule)
+		if err != nil {
+			log.Error("Failed to add rule", "error", err)
+			sendError(w, "failed to add rule", http.StatusInternalServerError)
+			return
+		}
+
+		if err := rules.Load(r.Context()); err != nil {
+			log.Error("Failed to reload rules", "error", err)
+		}
+
+		writeJSON(log, w, http.StatusCreated, newRuleResponse(rule))
+
+		log.Info("End adding rule")
+	}
+}
+
+func ListRulesHandler(log *slog.Logger, db repositories.DBInterface) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Debug("Listing rules handler")
+
+		list, err := db.ListRules(r.Context())
+		if err != nil {
+			log.Error("Failed to list rules", "error", err)
+			sendError(w, "failed to list rules", http.StatusInternalServerError)
+			return
+		}
+
+		response := make([]RuleResponse, 0, len(list))
+		for _, rule := range list {
+			response = append(response, newRuleResponse(rule))
+		}
+
+		writeJSON(log, w, http.StatusOK, response)
+	}
+}
+
+func GetRuleHandler(log *slog.Logger, db repositories.DBInterface) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Debug("Getting rule handler")
+
+		id, err := strconv.ParseInt(r.PathValue("ruleID"), 10, 64)
+		if err != nil {
+			sendError(w, "invalid rule id", http.StatusBadRequest)
+			return
+		}
+
+		rule, err := db.GetRule(r.Context(), id)
+		if errors.Is(err, apperrors.ErrNotFound) {
+			sendError(w, "rule not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Error("Failed to get rule", "error", err)
+			sendError(w, "failed to get rule", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(log, w, http.StatusOK, newRuleResponse(rule))
+	}
+}
+
+func EditRuleHandler(log *slog.Logger, db repositories.DBInterface, rules *rate_limiter.RuleSet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Debug("Editing rule handler")
+		log.Info("Start editing rule")
+
+		id, err := strconv.ParseInt(r.PathValue("ruleID"), 10, 64)
+		if err != nil {
+			sendError(w, "invalid rule id", http.StatusBadRequest)
+			return
+		}
+
+		var req RuleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Error("Failed to decode request body", "error", err)
+			sendError(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		rule, err := db.GetRule(r.Context(), id)
+		if errors.Is(err, apperrors.ErrNotFound) {
+			sendError(w, "rule not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Error("Failed to get rule", "error", err)
+			sendError(w, "failed to get rule", http.StatusInternalServerError)
+			return
+		}
+
+		if req.Pattern != "" {
+			rule.Pattern = req.Pattern
+		}
+		if req.Capacity > 0 {
+			rule.Capacity = req.Capacity
+		}
+		if req.RefillRate > 0 {
+			rule.RefillRate = time.Duration(req.RefillRate) * time.Second
+		}
+		if req.Scope != "" {
+			rule.Scope = req.Scope
+		}
+		if req.Mode != "" {
+			rule.Mode = req.Mode
+		}
+		if msg := validateRule(rules, rule); msg != "" {
+			sendError(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		err = db.UpdateRule(r.Context(), rule)
+		if errors.Is(err, apperrors.ErrNotFound) {
+			sendError(w, "rule not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Error("Failed to update rule", "error", err)
+			sendError(w, "failed to update rule", http.StatusInternalServerError)
+			return
+		}
+
+		if err := rules.Load(r.Context()); err != nil {
+			log.Error("Failed to reload rules", "error", err)
+		}
+
+		writeJSON(log, w, http.StatusOK, newRuleResponse(rule))
+
+		log.Info("End editing rule")
+	}
+}
+
+func DeleteRuleHandler(log *slog.Logger, db repositories.DBInterface, rules *rate_limiter.RuleSet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Debug("Deleting rule handler")
+		log.Info("Start deleting rule")
+
+		id, err := strconv.ParseInt(r.PathValue("ruleID"), 10, 64)
+		if err != nil {
+			sendError(w, "invalid rule id", http.StatusBadRequest)
+			return
+		}
+
+		err = db.DeleteRule(r.Context(), id)
+		if errors.Is(err, apperrors.ErrNotFound) {
+			sendError(w, "rule not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Error("Failed to delete rule", "error", err)
+			sendError(w, "failed to delete rule", http.StatusInternalServerError)
+			return
+		}
+
+		if err := rules.Load(r.Context()); err != nil {
+			log.Error("Failed to reload rules", "error", err)
+		}
+
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write([]byte("Rule deleted successfully\n")); err != nil {
+			log.Error("Error writing response", "error", err)
+		}
+
+		log.Info("End deleting rule")
+	}
+}
+
+func validateRule(rules *rate_limiter.RuleSet, rule repositories.Rule) string {
+	switch {
+	case rule.Pattern == "":
+		return "pattern is required"
+	case rule.Capacity < 0:
+		return "capacity must not be negative"
+	case rule.RefillRate <= 0:
+		return "refill_rate_seconds must be positive"
+	case rule.Scope != repositories.ScopeClient && rule.Scope != repositories.ScopeGlobal:
+		return "scope must be client or global"
+	case rule.Mode == "" || !validMode(rule.Mode):
+		return "mode must be enforce, shadow or off"
+	}
+
+	if err := rules.Validate(rule.ID, rule.Pattern); err != nil {
+		return "invalid pattern: " + err.Error()
+	}
+	return ""
+}
+
+func newRuleResponse(rule repositories.Rule) RuleResponse {
+	return RuleResponse{
+		ID:         rule.ID,
+		Pattern:    rule.Pattern,
+		Capacity:   rule.Capacity,
+		RefillRate: int(rule.RefillRate.Seconds()),
+		Scope:      rule.Scope,
+		Mode:       rule.Mode,
+	}
+}
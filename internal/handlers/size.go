@@ -0,0 +1,16 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+
+	"ratelimiter/internal/rate_limiter"
+)
+
+func ListSizeRejectionsHandler(log *slog.Logger, sizes *rate_limiter.SizeGuard) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Debug("Listing size rejections handler")
+
+		writeJSON(log, w, http.StatusOK, sizes.Rejections())
+	}
+}
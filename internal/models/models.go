@@ -13,3 +13,153 @@ type ClientLimit struct {
 	RefillRate time.Duration `yaml:"refill_rate_seconds"`
 	Unlimited  bool          `yaml:"unlimited"`
 }
+
+type RateLimitHeaders struct {
+	Legacy bool `yaml:"legacy" env:"RATE_LIMIT_HEADERS_LEGACY"`
+}
+
+type Identification struct {
+	Extractors         []KeyExtractor `yaml:"extractors"`
+	RejectUnidentified bool           `yaml:"reject_unidentified" env:"REJECT_UNIDENTIFIED"`
+}
+
+type KeyExtractor struct {
+	Type      string         `yaml:"type"`
+	Name      string         `yaml:"name"`
+	Header    string         `yaml:"header"`
+	Index     int            `yaml:"index"`
+	Prefix    string         `yaml:"prefix"`
+	Separator string         `yaml:"separator"`
+	Parts     []KeyExtractor `yaml:"parts"`
+}
+
+type AnonymousLimits struct {
+	IPv4Prefix  int   `yaml:"ipv4_prefix" env:"ANONYMOUS_IPV4_PREFIX"`
+	IPv6Prefix  int   `yaml:"ipv6_prefix" env:"ANONYMOUS_IPV6_PREFIX"`
+	PerIP       bool  `yaml:"per_ip" env:"ANONYMOUS_PER_IP"`
+	SubnetLimit Limit `yaml:"subnet_limit"`
+}
+
+type ProxyConfig struct {
+	Routes                []ProxyRoute  `yaml:"routes"`
+	DialTimeout           time.Duration `yaml:"dial_timeout" env:"PROXY_DIAL_TIMEOUT" env-default:"5s"`
+	KeepAlive             time.Duration `yaml:"keep_alive" env:"PROXY_KEEP_ALIVE" env-default:"30s"`
+	ResponseHeaderTimeout time.Duration `yaml:"response_header_timeout" env:"PROXY_RESPONSE_HEADER_TIMEOUT" env-default:"30s"`
+	ExpectContinueTimeout time.Duration `yaml:"expect_continue_timeout" env:"PROXY_EXPECT_CONTINUE_TIMEOUT" env-default:"1s"`
+	IdleConnTimeout       time.Duration `yaml:"idle_conn_timeout" env:"PROXY_IDLE_CONN_TIMEOUT" env-default:"90s"`
+	MaxIdleConnsPerHost   int           `yaml:"max_idle_conns_per_host" env:"PROXY_MAX_IDLE_CONNS_PER_HOST" env-default:"100"`
+	// FlushInterval of 0 flushes streamed responses such as server-sent
+	// events right away and buffers the others, -1 flushes after every write.
+	FlushInterval time.Duration `yaml:"flush_interval" env:"PROXY_FLUSH_INTERVAL"`
+}
+
+type ProxyRoute struct {
+	Prefix       string `yaml:"prefix"`
+	Upstream     string `yaml:"upstream"`
+	StripPrefix  bool   `yaml:"strip_prefix"`
+	PreserveHost bool   `yaml:"preserve_host"`
+}
+
+type ForwardAuth struct {
+	// DenyStatus is 429 by default. nginx auth_request only understands
+	// 401 and 403 as a denial and treats other codes as errors.
+	DenyStatus int `yaml:"deny_status" env:"FORWARD_AUTH_DENY_STATUS" env-default:"429"`
+}
+
+// Envoy configures the gRPC rate limit service used by Envoy's ratelimit
+// filter. Descriptor entries named in KeyEntries identify the client, and
+// the method and path entries are matched against the rules.
+type Envoy struct {
+	Address     string   `yaml:"address" env:"ENVOY_ADDRESS"`
+	KeyEntries  []string `yaml:"key_entries" env:"ENVOY_KEY_ENTRIES" env-separator:"," env-default:"client_id"`
+	MethodEntry string   `yaml:"method_entry" env:"ENVOY_METHOD_ENTRY" env-default:"method"`
+	PathEntry   string   `yaml:"path_entry" env:"ENVOY_PATH_ENTRY" env-default:"path"`
+}
+
+// Rejections customizes the response to requests over the limit. By default
+// it is an RFC 9457 problem.
+type Rejections struct {
+	Routes []RejectionRoute `yaml:"routes"`
+}
+
+// RejectionRoute applies to requests matching Pattern, an http.ServeMux
+// pattern. Template is a text/template rendering the ratelimit.Problem, or
+// an html/template for HTML and XML content types.
+type RejectionRoute struct {
+	Pattern     string `yaml:"pattern"`
+	Status      int    `yaml:"status"`
+	ContentType string `yaml:"content_type"`
+	Template    string `yaml:"template"`
+}
+
+// Bans bans clients that are rejected MaxRejections times within Window,
+// for BanTime at first and twice as long on every repeat, up to MaxBanTime.
+// Offenses are forgotten once a ban has been over for Forget.
+type Bans struct {
+	Enabled       bool          `yaml:"enabled" env:"BANS_ENABLED"`
+	MaxRejections int           `yaml:"max_rejections" env:"BANS_MAX_REJECTIONS" env-default:"100"`
+	Window        time.Duration `yaml:"window" env:"BANS_WINDOW" env-default:"1m"`
+	BanTime       time.Duration `yaml:"ban_time" env:"BANS_BAN_TIME" env-default:"5m"`
+	MaxBanTime    time.Duration `yaml:"max_ban_time" env:"BANS_MAX_BAN_TIME" env-default:"24h"`
+	Forget        time.Duration `yaml:"forget" env:"BANS_FORGET" env-default:"24h"`
+}
+
+// Connections limits upgraded connections like WebSockets. MaxPerKey caps
+// the connections a client holds at once, and the byte rates limit what it
+// sends over them, per connection and over all its connections together.
+type Connections struct {
+	MaxPerKey    int64    `yaml:"max_per_key" env:"CONNECTIONS_MAX_PER_KEY"`
+	BytesPerConn ByteRate `yaml:"bytes_per_conn"`
+	BytesPerKey  ByteRate `yaml:"bytes_per_key"`
+}
+
+// ByteRate allows bursts of Burst bytes and PerSecond bytes a second after.
+type ByteRate struct {
+	Burst     int64 `yaml:"burst"`
+	PerSecond int64 `yaml:"per_second"`
+}
+
+// Queue makes requests within the limits wait for a free slot in queues per
+// client, which take turns. Weights give the requests of a client served
+// per turn, DefaultWeight applies to the others.
+type Queue struct {
+	Enabled       bool           `yaml:"enabled" env:"QUEUE_ENABLED"`
+	Concurrency   int            `yaml:"concurrency" env:"QUEUE_CONCURRENCY" env-default:"100"`
+	MaxPerClient  int            `yaml:"max_per_client" env:"QUEUE_MAX_PER_CLIENT" env-default:"50"`
+	MaxWait       time.Duration  `yaml:"max_wait" env:"QUEUE_MAX_WAIT" env-default:"10s"`
+	DefaultWeight int            `yaml:"default_weight" env:"QUEUE_DEFAULT_WEIGHT" env-default:"1"`
+	Weights       map[string]int `yaml:"weights"`
+	IdleTTL       time.Duration  `yaml:"idle_ttl" env:"QUEUE_IDLE_TTL" env-default:"5m"`
+}
+
+// GraphQL prices requests matching Patterns, http.ServeMux patterns, by the
+// complexity of their GraphQL query. Weights are keyed by field name or by
+// "parent.field".
+type GraphQL struct {
+	Patterns      []string         `yaml:"patterns"`
+	Weights       map[string]int64 `yaml:"weights"`
+	DefaultWeight int64            `yaml:"default_weight" env:"GRAPHQL_DEFAULT_WEIGHT" env-default:"1"`
+	MaxComplexity int64            `yaml:"max_complexity" env:"GRAPHQL_MAX_COMPLEXITY"`
+	MaxBodyBytes  int64            `yaml:"max_body_bytes" env:"GRAPHQL_MAX_BODY_BYTES" env-default:"1048576"`
+}
+
+// RequestLimits bound the size of requests. Default applies to every
+// request and Routes to the requests matching their http.ServeMux pattern.
+// The limits of clients are stored with them. Client and route limits
+// replace the default one, and a request matching both has to fit both.
+type RequestLimits struct {
+	Default SizeLimit        `yaml:"default"`
+	Routes  []RouteSizeLimit `yaml:"routes"`
+}
+
+// SizeLimit fields of zero are not limited.
+type SizeLimit struct {
+	MaxBodyBytes   int64 `yaml:"max_body_bytes"`
+	MaxHeaderCount int   `yaml:"max_header_count"`
+	MaxHeaderBytes int64 `yaml:"max_header_bytes"`
+}
+
+type RouteSizeLimit struct {
+	Pattern   string `yaml:"pattern"`
+	SizeLimit `yaml:",inline"`
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"ratelimiter/internal/models"
+	"ratelimiter/pkg/ratelimit"
+)
+
+func NewTransport(cfg models.ProxyConfig) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   cfg.DialTimeout,
+			KeepAlive: cfg.KeepAlive,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		TLSHandshakeTimeout:   cfg.DialTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		ExpectContinueTimeout: cfg.ExpectContinueTimeout,
+	}
+}
+
+// New returns a reverse proxy that forwards the requests under route.Prefix
+// to route.Upstream. Headers pass through apart from hop-by-hop ones, the
+// X-Forwarded-* headers are extended with this hop, and streamed responses
+// as well as protocol upgrades such as WebSocket are passed on as they come.
+func New(log *slog.Logger, route models.ProxyRoute, transport http.RoundTripper, flushInterval time.Duration) (http.Handler, error) {
+	if !strings.HasPrefix(route.Prefix, "/") {
+		return nil, fmt.Errorf("invalid prefix %q: must start with /", route.Prefix)
+	}
+
+	target, err := url.Parse(route.Upstream)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream %q: %w", route.Upstream, err)
+	}
+	if target.Scheme == "" || target.Host == "" {
+		return nil, fmt.Errorf("invalid upstream %q: scheme and host are required", route.Upstream)
+	}
+
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			if route.StripPrefix {
+				pr.Out.URL.Path = "/" + strings.TrimLeft(strings.TrimPrefix(pr.In.URL.Path, route.Prefix), "/")
+				pr.Out.URL.RawPath = ""
+			}
+			pr.SetURL(target)
+			// keep the chain of the proxies in front of us
+			pr.Out.Header["X-Forwarded-For"] = pr.In.Header["X-Forwarded-For"]
+			pr.SetXForwarded()
+			if route.PreserveHost {
+				pr.Out.Host = pr.In.Host
+			}
+		},
+		Transport:     transport,
+		FlushInterval: flushInterval,
+		ErrorLog:      slog.NewLogLogger(log.Handler(), slog.LevelError),
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Error("upstream request failed", "upstream", route.Upstream, "path", r.URL.Path, "error", err)
+
+			problem := ratelimit.NewProblem(http.StatusBadGateway, "The upstream server could not be reached.")
+			var netErr net.Error
+			if p, ok := ratelimit.BodyTooLargeProblem(r, err); ok {
+				problem = p
+			} else if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+				problem = ratelimit.NewProblem(http.StatusGatewayTimeout, "The upstream server did not respond in time.")
+			}
+			problem.Instance = r.URL.Path
+			ratelimit.WriteProblem(w, problem)
+		},
+	}, nil
+}
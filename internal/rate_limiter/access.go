@@ -0,0 +1,162 @@
+package rate_limiter
+
+import (
+	"context"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"ratelimiter/internal/repositories"
+	"ratelimiter/pkg/ratelimit"
+)
+
+// AccessLists is the ratelimit.AccessList of the allowlist and denylist
+// entries stored in the database. A client on both lists is denied.
+type AccessLists struct {
+	log *slog.Logger
+	db  repositories.DBInterface
+
+	mu          sync.RWMutex
+	allow, deny *accessSet
+}
+
+type accessSet struct {
+	prefixes prefixTree
+	keys     map[string]time.Time
+	patterns []keyPattern
+}
+
+type keyPattern struct {
+	pattern string
+	expires time.Time
+}
+
+func NewAccessLists(log *slog.Logger, db repositories.DBInterface) *AccessLists {
+	return &AccessLists{
+		log:   log,
+		db:    db,
+		allow: newAccessSet(),
+		deny:  newAccessSet(),
+	}
+}
+
+func (a *AccessLists) Check(key string, addr netip.Addr) ratelimit.Access {
+	if a == nil {
+		return ratelimit.AccessDefault
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	now := time.Now()
+	switch {
+	case a.deny.contains(key, addr, now):
+		return ratelimit.AccessDeny
+	case a.allow.contains(key, addr, now):
+		return ratelimit.AccessAllow
+	}
+	return ratelimit.AccessDefault
+}
+
+// Load replaces the lists with the entries from the database.
+func (a *AccessLists) Load(ctx context.Context) error {
+	entries, err := a.db.ListAccessEntries(ctx)
+	if err != nil {
+		return err
+	}
+
+	allow, deny := newAccessSet(), newAccessSet()
+	for _, entry := range entries {
+		set := allow
+		if entry.List == repositories.DenyList {
+			set = deny
+		}
+		set.add(entry)
+	}
+
+	a.mu.Lock()
+	a.allow, a.deny = allow, deny
+	a.mu.Unlock()
+
+	a.log.Info("access lists loaded", "count", len(entries))
+	return nil
+}
+
+func (a *AccessLists) Channel() string {
+	return repositories.AccessChangesChannel
+}
+
+func (a *AccessLists) Reload(ctx context.Context) error {
+	return a.Load(ctx)
+}
+
+func (a *AccessLists) Apply(ctx context.Context, _ string) error {
+	return a.Load(ctx)
+}
+
+func newAccessSet() *accessSet {
+	return &accessSet{keys: make(map[string]time.Time)}
+}
+
+func (s *accessSet) add(entry repositories.AccessEntry) {
+	switch {
+	case entry.CIDR.IsValid():
+		s.prefixes.insert(entry.CIDR, entry.ExpiresAt)
+	case strings.Contains(entry.KeyPattern, "*"):
+		s.patterns = append(s.patterns, keyPattern{pattern: entry.KeyPattern, expires: entry.ExpiresAt})
+	case entry.KeyPattern != "":
+		if expires, ok := s.keys[entry.KeyPattern]; ok && (expires.IsZero() || expires.After(entry.ExpiresAt)) {
+			return
+		}
+		s.keys[entry.KeyPattern] = entry.ExpiresAt
+	}
+}
+
+func (s *accessSet) contains(key string, addr netip.Addr, now time.Time) bool {
+	if s.prefixes.contains(addr, now) {
+		return true
+	}
+	if key == "" {
+		return false
+	}
+
+	if expires, ok := s.keys[key]; ok && active(expires, now) {
+		return true
+	}
+	for _, p := range s.patterns {
+		if active(p.expires, now) && matchKey(p.pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func active(expires, now time.Time) bool {
+	return expires.IsZero() || now.Before(expires)
+}
+
+// matchKey matches key against a pattern where * stands for any run of
+// characters, including none.
+func matchKey(pattern, key string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == key
+	}
+
+	if !strings.HasPrefix(key, parts[0]) {
+		return false
+	}
+	key = key[len(parts[0]):]
+
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(key, part)
+		if i < 0 {
+			return false
+		}
+		key = key[i+len(part):]
+	}
+	return len(key) >= len(last) && strings.HasSuffix(key, last)
+}
@@ -0,0 +1,225 @@
+package rate_limiter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"ratelimiter/internal/models"
+	"ratelimiter/internal/repositories"
+	apperrors "ratelimiter/pkg/errors"
+)
+
+const (
+	banTimeout = 5 * time.Second
+	// banQueueSize bounds the bans waiting to be written, more are dropped
+	// and counted again
+	banQueueSize = 1024
+)
+
+// Bans is the ratelimit.Bans of the bans stored in the database. Rejections
+// are counted by every instance on its own, the bans they lead to are
+// shared. Bans are written by Start, so that requests never wait for the
+// database.
+type Bans struct {
+	log   *slog.Logger
+	db    repositories.DBInterface
+	cfg   models.Bans
+	queue chan banRequest
+
+	mu         sync.Mutex
+	banned     map[string]time.Time
+	rejections map[string]*rejectionWindow
+	// pending holds the keys whose ban is queued
+	pending map[string]bool
+}
+
+type banRequest struct {
+	key    string
+	reason string
+}
+
+type rejectionWindow struct {
+	start time.Time
+	count int
+}
+
+type banChange struct {
+	Op  string `json:"op"`
+	Key string `json:"key"`
+}
+
+func NewBans(log *slog.Logger, db repositories.DBInterface, cfg models.Bans) *Bans {
+	return &Bans{
+		log:        log,
+		db:         db,
+		cfg:        cfg,
+		queue:      make(chan banRequest, banQueueSize),
+		banned:     make(map[string]time.Time),
+		rejections: make(map[string]*rejectionWindow),
+		pending:    make(map[string]bool),
+	}
+}
+
+func (b *Bans) BannedUntil(key string) (time.Time, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	until, ok := b.banned[key]
+	if !ok || !time.Now().Before(until) {
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+// Rejected queues the ban of key once it has been rejected MaxRejections
+// times within the window.
+func (b *Bans) Rejected(_ context.Context, key string) {
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	win, ok := b.rejections[key]
+	if !ok || now.Sub(win.start) >= b.cfg.Window {
+		win = &rejectionWindow{start: now}
+		b.rejections[key] = win
+	}
+	win.count++
+	if win.count < b.cfg.MaxRejections {
+		return
+	}
+	delete(b.rejections, key)
+	if b.pending[key] {
+		return
+	}
+
+	req := banRequest{key: key, reason: strconv.Itoa(win.count) + " rejections within " + b.cfg.Window.String()}
+	select {
+	case b.queue <- req:
+		b.pending[key] = true
+	default:
+		b.log.Warn("ban queue is full, dropping ban", "key", key)
+	}
+}
+
+func (b *Bans) ban(ctx context.Context, req banRequest) {
+	ctx, cancel := context.WithTimeout(ctx, banTimeout)
+	defer cancel()
+
+	ban, err := b.db.AddBan(ctx, req.key, req.reason, b.cfg.BanTime, b.cfg.MaxBanTime, b.cfg.Forget)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.pending, req.key)
+	if err != nil {
+		b.log.Error("failed to ban client", "key", req.key, "error", err)
+		return
+	}
+
+	b.log.Warn("client banned", "key", req.key, "offenses", ban.Offenses, "until", ban.BannedUntil)
+	b.banned[req.key] = ban.BannedUntil
+}
+
+// Lift ends the ban of key and forgets its offenses and rejections.
+func (b *Bans) Lift(ctx context.Context, key string) error {
+	if err := b.db.LiftBan(ctx, key); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	delete(b.banned, key)
+	delete(b.rejections, key)
+	b.mu.Unlock()
+	return nil
+}
+
+// Load replaces the bans with the ones in effect in the database.
+func (b *Bans) Load(ctx context.Context) error {
+	bans, err := b.db.ListBans(ctx)
+	if err != nil {
+		return err
+	}
+
+	banned := make(map[string]time.Time, len(bans))
+	for _, ban := range bans {
+		banned[ban.Key] = ban.BannedUntil
+	}
+
+	b.mu.Lock()
+	b.banned = banned
+	b.mu.Unlock()
+
+	b.log.Info("bans loaded", "count", len(bans))
+	return nil
+}
+
+// Start writes the queued bans, and drops expired bans and stale rejection
+// counts, until ctx is done.
+func (b *Bans) Start(ctx context.Context) {
+	ticker := time.NewTicker(b.cfg.Window)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case req := <-b.queue:
+			b.ban(ctx, req)
+		case now := <-ticker.C:
+			b.mu.Lock()
+			for key, until := range b.banned {
+				if !now.Before(until) {
+					delete(b.banned, key)
+				}
+			}
+			for key, win := range b.rejections {
+				if now.Sub(win.start) >= b.cfg.Window {
+					delete(b.rejections, key)
+				}
+			}
+			b.mu.Unlock()
+		}
+	}
+}
+
+func (b *Bans) Channel() string {
+	return repositories.BanChangesChannel
+}
+
+func (b *Bans) Reload(ctx context.Context) error {
+	return b.Load(ctx)
+}
+
+func (b *Bans) Apply(ctx context.Context, payload string) error {
+	var change banChange
+	if err := json.Unmarshal([]byte(payload), &change); err != nil {
+		return err
+	}
+
+	if change.Op == repositories.BanLifted {
+		b.log.Info("Ban lifted", "key", change.Key)
+		b.mu.Lock()
+		delete(b.banned, change.Key)
+		delete(b.rejections, change.Key)
+		b.mu.Unlock()
+		return nil
+	}
+
+	ban, err := b.db.GetBan(ctx, change.Key)
+	if errors.Is(err, apperrors.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	b.banned[ban.Key] = ban.BannedUntil
+	b.mu.Unlock()
+	return nil
+}
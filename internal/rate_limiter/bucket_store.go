@@ -1,23 +1,120 @@
 package rate_limiter
 
 import (
+	"context"
+	"net/netip"
 	"ratelimiter/internal/models"
+	"ratelimiter/internal/repositories"
+	"ratelimiter/pkg/ratelimit"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Client keys come from requests, so their buckets are kept apart from the
+// buckets of rules, subnets and connections, which would otherwise be
+// drained by sending their keys.
+const (
+	clientBucketPrefix = "client:"
+	subnetBucketPrefix = "subnet:"
+)
+
+func ClientBucketKey(key string) string {
+	return clientBucketPrefix + key
+}
+
+func SubnetBucketKey(subnet netip.Prefix) string {
+	return subnetBucketPrefix + subnet.String()
+}
+
+// BucketSource creates the bucket of a key forwarded by a peer from the
+// limits this instance knows, so that the owner of a key never has to trust
+// the limit of the peer asking. It reports false for unknown keys.
+type BucketSource func(ctx context.Context, key string) (*TokenBucket, bool)
+
 type BucketStore struct {
 	buckets map[string]*TokenBucket
+	peers   atomic.Pointer[PeerGroup]
+	// sources are keyed by the prefix of the keys they create buckets for,
+	// only their keys are forwarded to peers
+	sources map[string]BucketSource
 	mu      sync.RWMutex
 }
 
 func NewBucketStore() *BucketStore {
 	return &BucketStore{
 		buckets: make(map[string]*TokenBucket),
+		sources: make(map[string]BucketSource),
+	}
+}
+
+func (s *BucketStore) UsePeers(pg *PeerGroup) {
+	s.peers.Store(pg)
+}
+
+func (s *BucketStore) addSource(prefix string, source BucketSource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sources[prefix] = source
+}
+
+func (s *BucketStore) source(key string) BucketSource {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for prefix, source := range s.sources {
+		if strings.HasPrefix(key, prefix) {
+			return source
+		}
+	}
+	return nil
+}
+
+// forward asks the owner of key for a decision. Keys without a source are
+// always decided locally, as their owner could not tell their limit.
+func (s *BucketStore) forward(ctx context.Context, key string, cost int64) (ratelimit.Result, bool) {
+	pg := s.peers.Load()
+	if pg == nil || s.source(key) == nil {
+		return ratelimit.Result{}, false
 	}
+	return pg.Forward(ctx, key, cost)
 }
 
 func (s *BucketStore) GetOrCreate(key string, limit models.Limit) *TokenBucket {
+	return s.getOrCreate(key, func() *TokenBucket {
+		tb := NewTokenBucket(limit.Capacity, time.Second*time.Duration(limit.RefillRate), false)
+		tb.fallback = true
+		return tb
+	})
+}
+
+// TakeLocal makes the decision on this instance without consulting peers.
+// It is used by the owner of a key to answer forwarded requests, and
+// reports false if the key has no bucket and no source to create one.
+func (s *BucketStore) TakeLocal(ctx context.Context, key string, cost int64) (ratelimit.Result, bool) {
+	bucket := s.Get(key)
+	if bucket == nil {
+		source := s.source(key)
+		if source == nil {
+			return ratelimit.Result{}, false
+		}
+		var ok bool
+		if bucket, ok = source(ctx, key); !ok {
+			return ratelimit.Result{}, false
+		}
+	}
+	return bucket.takeLocal(max(1, cost)), true
+}
+
+// Bucket implements ratelimit.Store, so that the buckets of keys are shared
+// with the peers.
+func (s *BucketStore) Bucket(_ context.Context, key string, limit ratelimit.Limit) ratelimit.Bucket {
+	return s.getOrCreate(key, func() *TokenBucket {
+		return NewTokenBucket(limit.Capacity, limit.RefillRate, limit.Unlimited)
+	})
+}
+
+func (s *BucketStore) getOrCreate(key string, create func() *TokenBucket) *TokenBucket {
 	s.mu.RLock()
 	b, exists := s.buckets[key]
 	s.mu.RUnlock()
@@ -32,7 +129,24 @@ func (s *BucketStore) GetOrCreate(key string, limit models.Limit) *TokenBucket {
 		return b
 	}
 
-	tb := NewTokenBucket(limit.Capacity, time.Second*time.Duration(limit.RefillRate), false)
+	tb := create()
+	s.attach(key, tb)
+	s.buckets[key] = tb
+	return tb
+}
+
+// replace installs the bucket made by create for key if key has no bucket
+// or still has old, and returns the bucket of key. Concurrent callers
+// replacing the same bucket all get the one of the caller that won.
+func (s *BucketStore) replace(key string, old *TokenBucket, create func() *TokenBucket) *TokenBucket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b, exists := s.buckets[key]; exists && b != old {
+		return b
+	}
+
+	tb := create()
+	s.attach(key, tb)
 	s.buckets[key] = tb
 	return tb
 }
@@ -46,15 +160,109 @@ func (s *BucketStore) Get(key string) *TokenBucket {
 func (s *BucketStore) Set(key string, bucket *TokenBucket) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.attach(key, bucket)
 	s.buckets[key] = bucket
 }
 
+// Update applies the changed limit and mode of client to its bucket, and
+// sets the tokens by policy. It returns the state before, which is nil if
+// the client had no bucket yet, and after.
+func (s *BucketStore) Update(client repositories.Client, policy ratelimit.TokenPolicy) (*BucketState, BucketState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := ClientBucketKey(client.Key)
+	old, exists := s.buckets[key]
+	if !exists {
+		tb := NewClientBucket(client)
+		s.attach(key, tb)
+		s.buckets[key] = tb
+		return nil, tb.State()
+	}
+
+	before := old.State()
+	old.TokenBucket.SetLimit(ratelimit.Limit{
+		Capacity:   client.Capacity,
+		RefillRate: client.RefillRate,
+		Unlimited:  client.Unlimited,
+	}, policy)
+
+	// the mode and size limits are read without a lock, so the bucket is
+	// replaced by one sharing the tokens
+	tb := &TokenBucket{TokenBucket: old.TokenBucket, mode: client.Mode, sizes: clientSizeLimits(client)}
+	tb.shadowRejections.Store(old.shadowRejections.Load())
+	s.attach(key, tb)
+	s.buckets[key] = tb
+	return &before, tb.State()
+}
+
+// attach is called before the bucket is added, so that its fields are
+// never written while others read them.
+func (s *BucketStore) attach(key string, bucket *TokenBucket) {
+	bucket.store = s
+	bucket.key = key
+}
+
+type KeyedBucketState struct {
+	Key string
+	BucketState
+}
+
+func (s *BucketStore) States() []KeyedBucketState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	states := make([]KeyedBucketState, 0, len(s.buckets))
+	for key, bucket := range s.buckets {
+		states = append(states, KeyedBucketState{Key: key, BucketState: bucket.State()})
+	}
+	return states
+}
+
 func (s *BucketStore) Delete(key string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	delete(s.buckets, key)
 }
 
+// usage returns the demand of the keys that had any since the last call,
+// and the keys whose share has to be recomputed: those, and the keys that
+// are limited to a share of their limit.
+func (s *BucketStore) usage() ([]repositories.QuotaUsage, []string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var usage []repositories.QuotaUsage
+	var tracked []string
+	for key, bucket := range s.buckets {
+		if bucket.Limit().Unlimited {
+			continue
+		}
+		demand, admitted := bucket.TakeUsage()
+		if demand > 0 {
+			usage = append(usage, repositories.QuotaUsage{
+				Key:      key,
+				Demand:   demand,
+				Admitted: admitted,
+			})
+		}
+		if demand > 0 || bucket.TokenBucket.State().Share < 1 {
+			tracked = append(tracked, key)
+		}
+	}
+	return usage, tracked
+}
+
+func (s *BucketStore) DeleteFunc(del func(key string, bucket *TokenBucket) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, bucket := range s.buckets {
+		if del(key, bucket) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
 func (s *BucketStore) StartBackgroundRefill(interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
@@ -62,7 +270,7 @@ func (s *BucketStore) StartBackgroundRefill(interval time.Duration) {
 	for range ticker.C {
 		s.mu.RLock()
 		for _, bucket := range s.buckets {
-			if !bucket.unlimited && interval <= bucket.refillRate {
+			if st := bucket.TokenBucket.State(); !st.Unlimited && interval <= st.RefillRate {
 				bucket.Refill()
 			}
 		}
@@ -70,17 +278,17 @@ func (s *BucketStore) StartBackgroundRefill(interval time.Duration) {
 	}
 }
 
-func (tb *TokenBucket) Refill() {
-	tb.mu.Lock()
-	defer tb.mu.Unlock()
-
-	now := time.Now()
-	elapsed := now.Sub(tb.lastRefill)
-
-	newTokens := int64(elapsed / tb.refillRate)
+// StartEviction drops the default, rule, Envoy and connection buckets that
+// have refilled completely, every interval. Such a bucket is created again
+// the same way on the next request of its key, so only the memory of idle
+// keys is given back.
+func (s *BucketStore) StartEviction(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-	if newTokens > 0 {
-		tb.tokens = min(tb.capacity, tb.tokens+newTokens)
-		tb.lastRefill = now
+	for range ticker.C {
+		s.DeleteFunc(func(key string, bucket *TokenBucket) bool {
+			return (bucket.fallback || bucket.evictable || strings.HasPrefix(key, ratelimit.ConnKeyPrefix)) && bucket.idle()
+		})
 	}
 }
@@ -0,0 +1,76 @@
+package rate_limiter
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"ratelimiter/pkg/ratelimit"
+)
+
+const CheckPath = "/check"
+
+// CheckHandler answers the forward-auth subrequests of nginx auth_request,
+// Traefik ForwardAuth and Envoy ext_authz. It takes a token for the original
+// request described by the forwarded headers and responds 200 or denyStatus,
+// with the rate limit headers either way.
+func CheckHandler(mw *ratelimit.Middleware, denyStatus int) http.Handler {
+	if denyStatus == 0 {
+		denyStatus = http.StatusTooManyRequests
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		orig := originalRequest(r)
+		res, key, ok := mw.Take(w, orig)
+		if !ok {
+			return
+		}
+
+		mw.SetHeaders(w.Header(), res)
+		if !res.Allowed {
+			p := ratelimit.RateLimitedProblem(orig, key, res)
+			p.Status = denyStatus
+			ratelimit.WriteProblem(w, p)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// originalRequest rebuilds the request the proxy asks about. nginx passes it
+// in X-Original-URI and X-Original-Method, Traefik in X-Forwarded-Uri and
+// X-Forwarded-Method, and Envoy appends the original path to the check path.
+func originalRequest(r *http.Request) *http.Request {
+	out := r.Clone(r.Context())
+
+	if method := firstHeader(r, "X-Forwarded-Method", "X-Original-Method"); method != "" {
+		out.Method = method
+	}
+
+	uri := firstHeader(r, "X-Original-URI", "X-Forwarded-Uri")
+	if uri == "" {
+		if rest, ok := strings.CutPrefix(r.URL.RequestURI(), CheckPath+"/"); ok {
+			uri = "/" + rest
+		}
+	}
+	if u, err := url.ParseRequestURI(uri); err == nil {
+		out.URL = u
+		out.RequestURI = uri
+	}
+
+	if host := r.Header.Get("X-Forwarded-Host"); host != "" {
+		out.Host = host
+	}
+
+	return out
+}
+
+func firstHeader(r *http.Request, names ...string) string {
+	for _, name := range names {
+		if v := r.Header.Get(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,42 @@
+package rate_limiter
+
+import (
+	"context"
+	"time"
+
+	"ratelimiter/internal/models"
+	"ratelimiter/pkg/ratelimit"
+)
+
+// NewConnLimits turns the byte rates of cfg into token bucket limits, where
+// a token is a byte. A rate of zero is not limited. The per-key buckets are
+// kept in store, which creates them for peers as well.
+func NewConnLimits(store *BucketStore, cfg models.Connections) ratelimit.ConnLimits {
+	limits := ratelimit.ConnLimits{
+		PerConn: byteLimit(cfg.BytesPerConn),
+		PerKey:  byteLimit(cfg.BytesPerKey),
+	}
+	if limits.PerKey.Capacity > 0 {
+		store.addSource(ratelimit.ConnKeyPrefix, func(_ context.Context, key string) (*TokenBucket, bool) {
+			return store.getOrCreate(key, func() *TokenBucket {
+				return NewTokenBucket(limits.PerKey.Capacity, limits.PerKey.RefillRate, false)
+			}), true
+		})
+	}
+	return limits
+}
+
+func byteLimit(rate models.ByteRate) ratelimit.Limit {
+	if rate.PerSecond <= 0 {
+		return ratelimit.Limit{}
+	}
+
+	burst := rate.Burst
+	if burst <= 0 {
+		burst = rate.PerSecond
+	}
+	return ratelimit.Limit{
+		Capacity:   burst,
+		RefillRate: max(time.Nanosecond, time.Second/time.Duration(rate.PerSecond)),
+	}
+}
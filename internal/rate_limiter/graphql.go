@@ -0,0 +1,42 @@
+package rate_limiter
+
+import (
+	"fmt"
+	"net/http"
+
+	"ratelimiter/internal/models"
+	"ratelimiter/pkg/ratelimit"
+)
+
+// graphQLAnalyzer prices the requests to the GraphQL endpoints, the others
+// take a single token.
+type graphQLAnalyzer struct {
+	mux      *http.ServeMux
+	analyzer *ratelimit.GraphQLAnalyzer
+}
+
+func NewGraphQLAnalyzer(cfg models.GraphQL) (ratelimit.RequestAnalyzer, error) {
+	mux := http.NewServeMux()
+	for i, pattern := range cfg.Patterns {
+		if err := registerPattern(mux, pattern); err != nil {
+			return nil, fmt.Errorf("graphql pattern %d: %w", i, err)
+		}
+	}
+
+	return &graphQLAnalyzer{
+		mux: mux,
+		analyzer: ratelimit.NewGraphQLAnalyzer(ratelimit.GraphQLOptions{
+			Weights:       cfg.Weights,
+			DefaultWeight: cfg.DefaultWeight,
+			MaxComplexity: cfg.MaxComplexity,
+			MaxBodyBytes:  cfg.MaxBodyBytes,
+		}),
+	}, nil
+}
+
+func (a *graphQLAnalyzer) Analyze(r *http.Request) (int64, error) {
+	if _, pattern := a.mux.Handler(r); pattern == "" {
+		return 1, nil
+	}
+	return a.analyzer.Analyze(r)
+}
@@ -0,0 +1,85 @@
+package rate_limiter
+
+import (
+	"fmt"
+
+	"ratelimiter/internal/models"
+	"ratelimiter/pkg/ratelimit"
+)
+
+func NewKeyChain(cfgs []models.KeyExtractor, ips *ratelimit.IPResolver) (ratelimit.KeyChain, error) {
+	if len(cfgs) == 0 {
+		return ratelimit.DefaultKeyChain, nil
+	}
+
+	chain := make(ratelimit.KeyChain, 0, len(cfgs))
+	for i, cfg := range cfgs {
+		e, err := NewKeyExtractor(cfg, ips)
+		if err != nil {
+			return nil, fmt.Errorf("extractor %d: %w", i, err)
+		}
+		chain = append(chain, e)
+	}
+	return chain, nil
+}
+
+func NewKeyExtractor(cfg models.KeyExtractor, ips *ratelimit.IPResolver) (ratelimit.KeyExtractor, error) {
+	var e ratelimit.KeyExtractor
+	switch cfg.Type {
+	case "header":
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("header extractor needs a name")
+		}
+		e = ratelimit.HeaderKey(cfg.Name)
+	case "query":
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("query extractor needs a name")
+		}
+		e = ratelimit.QueryKey(cfg.Name)
+	case "cookie":
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("cookie extractor needs a name")
+		}
+		e = ratelimit.CookieKey(cfg.Name)
+	case "basic_auth":
+		e = ratelimit.BasicAuthKey()
+	case "path_segment":
+		if cfg.Index < 0 {
+			return nil, fmt.Errorf("path segment index must not be negative")
+		}
+		e = ratelimit.PathSegmentKey(cfg.Index)
+	case "jwt_claim":
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("jwt claim extractor needs a claim name")
+		}
+		e = ratelimit.JWTClaimKey(cfg.Header, cfg.Name)
+	case "ip":
+		e = ratelimit.IPKey(ips)
+	case "route":
+		e = ratelimit.RouteKey()
+	case "composite":
+		if len(cfg.Parts) == 0 {
+			return nil, fmt.Errorf("composite extractor needs parts")
+		}
+		parts := make([]ratelimit.KeyExtractor, 0, len(cfg.Parts))
+		for i, p := range cfg.Parts {
+			part, err := NewKeyExtractor(p, ips)
+			if err != nil {
+				return nil, fmt.Errorf("part %d: %w", i, err)
+			}
+			parts = append(parts, part)
+		}
+		sep := cfg.Separator
+		if sep == "" {
+			sep = ":"
+		}
+		e = ratelimit.CompositeKey(sep, parts...)
+	default:
+		return nil, fmt.Errorf("unknown extractor type %q", cfg.Type)
+	}
+
+	if cfg.Prefix != "" {
+		return ratelimit.PrefixedKey(cfg.Prefix, e), nil
+	}
+	return e, nil
+}
@@ -0,0 +1,159 @@
+package rate_limiter
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"time"
+
+	"ratelimiter/internal/models"
+	"ratelimiter/internal/repositories"
+	"ratelimiter/pkg/ratelimit"
+)
+
+// Limiter decides whether a request with the given key may pass, creating
+// buckets from the database or from the default limit as keys show up.
+type Limiter struct {
+	store        *BucketStore
+	defaultLimit models.Limit
+	anonymous    models.AnonymousLimits
+	lookup       *ClientLookup
+}
+
+func NewLimiter(store *BucketStore, defaultLimit models.Limit, anonymous models.AnonymousLimits, lookup *ClientLookup) *Limiter {
+	if anonymous.SubnetLimit.Capacity == 0 {
+		anonymous.SubnetLimit = defaultLimit
+	}
+
+	l := &Limiter{
+		store:        store,
+		defaultLimit: defaultLimit,
+		anonymous:    anonymous,
+		lookup:       lookup,
+	}
+	store.addSource(clientBucketPrefix, l.clientBucket)
+	store.addSource(subnetBucketPrefix, l.subnetBucket)
+	return l
+}
+
+func (l *Limiter) Take(ctx context.Context, key string, cost int64) ratelimit.Result {
+	bucket := l.bucket(ctx, key, l.defaultLimit)
+	res := bucket.TakeNContext(ctx, cost)
+	res.Policy = "client"
+	if bucket.fallback {
+		res.Policy = "default"
+	}
+	return res
+}
+
+// TakeAnonymous limits a client known only by its address. If subnets are
+// configured, the address counts against the bucket of its subnet, and
+// against its own bucket as well when PerIP is set.
+func (l *Limiter) TakeAnonymous(ctx context.Context, addr netip.Addr, cost int64) ratelimit.Result {
+	subnet, ok := l.subnet(addr)
+	if !ok {
+		return l.Take(ctx, addr.String(), cost)
+	}
+
+	var res ratelimit.Result
+	if l.anonymous.PerIP {
+		// the address goes first, so that a single rejected address
+		// does not use up the tokens of its whole subnet
+		res = l.Take(ctx, addr.String(), cost)
+		if !res.Allowed {
+			return res
+		}
+	}
+
+	subnetRes := l.store.GetOrCreate(SubnetBucketKey(subnet), l.anonymous.SubnetLimit).TakeNContext(ctx, cost)
+	subnetRes.Policy = SubnetBucketKey(subnet)
+	if !l.anonymous.PerIP {
+		return subnetRes
+	}
+	return ratelimit.MostRestrictive(res, subnetRes)
+}
+
+// TakeRule limits a request matching rule by the rule's bucket instead of
+// the bucket of its client.
+func (l *Limiter) TakeRule(ctx context.Context, rule repositories.Rule, key string, cost int64) ratelimit.Result {
+	res := ruleBucket(l.store, rule, RuleBucketKey(rule, key)).TakeNContext(ctx, cost)
+	res.Policy = ruleBucketPrefix(rule.ID)
+	return res
+}
+
+// TakeLimit limits key by the given limit instead of a client's one. If the
+// limit of key changes, its bucket keeps its tokens up to the new capacity.
+// The bucket is evicted once it is idle, since every request brings its
+// limit.
+func (l *Limiter) TakeLimit(ctx context.Context, key string, capacity int64, refillRate time.Duration, cost int64) ratelimit.Result {
+	bucket := l.store.getOrCreate(key, func() *TokenBucket {
+		tb := NewTokenBucket(capacity, refillRate, false)
+		tb.evictable = true
+		return tb
+	})
+	if limit := (ratelimit.Limit{Capacity: capacity, RefillRate: refillRate}); bucket.Limit() != limit {
+		bucket.TokenBucket.SetLimit(limit, ratelimit.PreserveTokens)
+	}
+	return bucket.TakeNContext(ctx, cost)
+}
+
+func (l *Limiter) subnet(addr netip.Addr) (netip.Prefix, bool) {
+	bits := l.anonymous.IPv6Prefix
+	if addr.Is4() {
+		bits = l.anonymous.IPv4Prefix
+	}
+	if bits <= 0 || bits >= addr.BitLen() {
+		return netip.Prefix{}, false
+	}
+
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	return prefix, true
+}
+
+// bucket returns the bucket of a client key. Keys without a client get a
+// default bucket, which is replaced once the client is added and announced.
+// The lookup is only repeated for default buckets of keys that could not be
+// looked up.
+func (l *Limiter) bucket(ctx context.Context, key string, defaultLimit models.Limit) *TokenBucket {
+	bucketKey := ClientBucketKey(key)
+	bucket := l.store.Get(bucketKey)
+	if bucket != nil && !bucket.unresolved.Load() {
+		return bucket
+	}
+
+	dbClient, found, err := l.lookup.Lookup(ctx, key)
+	switch {
+	case found:
+		bucket = l.store.replace(bucketKey, bucket, func() *TokenBucket {
+			return NewClientBucket(dbClient)
+		})
+	case bucket == nil:
+		bucket = l.store.GetOrCreate(bucketKey, defaultLimit)
+		if err != nil {
+			bucket.unresolved.Store(true)
+		}
+	case err == nil:
+		bucket.unresolved.Store(false)
+	}
+	return bucket
+}
+
+// clientBucket and subnetBucket create the buckets of the keys that peers
+// forward to this instance.
+func (l *Limiter) clientBucket(ctx context.Context, bucketKey string) (*TokenBucket, bool) {
+	return l.bucket(ctx, strings.TrimPrefix(bucketKey, clientBucketPrefix), l.defaultLimit), true
+}
+
+func (l *Limiter) subnetBucket(_ context.Context, bucketKey string) (*TokenBucket, bool) {
+	subnet, err := netip.ParsePrefix(strings.TrimPrefix(bucketKey, subnetBucketPrefix))
+	if err != nil {
+		return nil, false
+	}
+	if want, ok := l.subnet(subnet.Addr()); !ok || want != subnet {
+		return nil, false
+	}
+	return l.store.GetOrCreate(bucketKey, l.anonymous.SubnetLimit), true
+}
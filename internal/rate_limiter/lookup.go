@@ -0,0 +1,135 @@
+package rate_limiter
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/sync/singleflight"
+
+	"ratelimiter/internal/repositories"
+)
+
+// ClientLookup finds clients in the database for keys that have no bucket yet.
+// Unknown keys are remembered for a while, concurrent lookups of the same key
+// share one query and the number of queries per second is limited, so that
+// random keys cannot turn every request into a database round trip.
+type ClientLookup struct {
+	log      *slog.Logger
+	db       repositories.DBInterface
+	negative *negativeCache
+	group    singleflight.Group
+	limiter  *TokenBucket
+}
+
+func NewClientLookup(log *slog.Logger, db repositories.DBInterface, negativeTTL time.Duration, negativeSize int, maxLookupsPerSecond int64) *ClientLookup {
+	l := &ClientLookup{
+		log:      log,
+		db:       db,
+		negative: newNegativeCache(negativeTTL, negativeSize),
+	}
+	if maxLookupsPerSecond > 0 {
+		l.limiter = NewTokenBucket(maxLookupsPerSecond, time.Second/time.Duration(maxLookupsPerSecond), false)
+	}
+	return l
+}
+
+// Lookup reports false if there is no client with the given key. It fails
+// if that could not be checked right now.
+func (l *ClientLookup) Lookup(ctx context.Context, key string) (repositories.Client, bool, error) {
+	if l.negative.contains(key) {
+		return repositories.Client{}, false, nil
+	}
+
+	res, err, _ := l.group.Do(key, func() (any, error) {
+		if l.limiter != nil && !l.limiter.takeLocal(1).Allowed {
+			l.log.Warn("client lookup limit exceeded, using default limit", "key", key)
+			return nil, errLookupSkipped
+		}
+
+		client, err := l.db.GetClient(context.WithoutCancel(ctx), key)
+		if errors.Is(err, pgx.ErrNoRows) {
+			l.negative.add(key)
+		}
+		return client, err
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return repositories.Client{}, false, nil
+	}
+	if err != nil {
+		return repositories.Client{}, false, err
+	}
+
+	return res.(repositories.Client), true, nil
+}
+
+var errLookupSkipped = errors.New("client lookup skipped")
+
+type negativeCache struct {
+	ttl     time.Duration
+	size    int
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type negativeEntry struct {
+	key     string
+	expires time.Time
+}
+
+func newNegativeCache(ttl time.Duration, size int) *negativeCache {
+	return &negativeCache{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (c *negativeCache) contains(key string) bool {
+	if c.ttl <= 0 || c.size <= 0 {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(el.Value.(*negativeEntry).expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return false
+	}
+	return true
+}
+
+func (c *negativeCache) add(key string) {
+	if c.ttl <= 0 || c.size <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		el.Value.(*negativeEntry).expires = time.Now().Add(c.ttl)
+		c.order.MoveToBack(el)
+		return
+	}
+
+	for c.order.Len() >= c.size {
+		oldest := c.order.Front()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*negativeEntry).key)
+	}
+
+	c.entries[key] = c.order.PushBack(&negativeEntry{key: key, expires: time.Now().Add(c.ttl)})
+}
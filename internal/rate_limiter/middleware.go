@@ -2,37 +2,30 @@ package rate_limiter
 
 import (
 	"net/http"
-	"ratelimiter/internal/models"
-	"ratelimiter/internal/repositories"
-	"strings"
-)
+	"net/netip"
 
-func RateLimitMiddleware(store *BucketStore, defaultLimit models.Limit, db repositories.DBInterface) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			key := r.Header.Get("X-API-Key")
-			if key == "" {
-				ip, _, _ := strings.Cut(r.RemoteAddr, ":")
-				key = ip
-			}
+	"ratelimiter/pkg/ratelimit"
+)
 
-			bucket := store.Get(key)
-			if bucket == nil {
-				dbClient, err := db.GetClient(r.Context(), key)
-				if err == nil {
-					bucket = NewTokenBucket(dbClient.Capacity, dbClient.RefillRate, dbClient.Unlimited)
-					store.Set(key, bucket)
-				} else {
-					bucket = store.GetOrCreate(key, defaultLimit)
-				}
-			}
+// RouteLimiter is the ratelimit.RequestLimiter of the service. A request
+// matching a rule counts against the rule's bucket, an anonymous one against
+// the buckets of its address and subnet, and any other against the bucket
+// of its client.
+type RouteLimiter struct {
+	*Limiter
+	rules *RuleSet
+}
 
-			if !bucket.Allow() {
-				http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
-				return
-			}
+func NewRouteLimiter(limiter *Limiter, rules *RuleSet) *RouteLimiter {
+	return &RouteLimiter{Limiter: limiter, rules: rules}
+}
 
-			next.ServeHTTP(w, r)
-		})
+func (l *RouteLimiter) TakeRequest(r *http.Request, key string, addr netip.Addr, cost int64) ratelimit.Result {
+	if rule, ok := l.rules.Match(r); ok {
+		return l.TakeRule(r.Context(), rule, key, cost)
+	}
+	if addr.IsValid() {
+		return l.TakeAnonymous(r.Context(), addr, cost)
 	}
+	return l.Take(r.Context(), key, cost)
 }
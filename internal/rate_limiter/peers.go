@@ -0,0 +1,178 @@
+package rate_limiter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"ratelimiter/pkg/ratelimit"
+)
+
+const (
+	PeerAllowPath = "/internal/peers/allow"
+	// PeerSecretHeader carries the secret shared by the peers, requests
+	// without it are not answered
+	PeerSecretHeader = "X-Peer-Secret"
+	ringReplicas     = 100
+	peerDownPeriod   = 5 * time.Second
+)
+
+// PeerAllowRequest asks the owner of a key for a decision. It carries no
+// limit, the owner knows the limit of the key itself.
+type PeerAllowRequest struct {
+	Key  string `json:"key"`
+	Cost int64  `json:"cost"`
+}
+
+type PeerGroup struct {
+	log    *slog.Logger
+	self   string
+	secret string
+	client *http.Client
+
+	mu    sync.RWMutex
+	peers []string
+	ring  *HashRing
+	down  map[string]time.Time
+}
+
+func NewPeerGroup(log *slog.Logger, self, secret string, peers []string, timeout time.Duration) *PeerGroup {
+	pg := &PeerGroup{
+		log:    log,
+		self:   strings.TrimSuffix(self, "/"),
+		secret: secret,
+		client: &http.Client{Timeout: timeout},
+		down:   make(map[string]time.Time),
+	}
+	pg.SetPeers(peers)
+	return pg
+}
+
+func (pg *PeerGroup) SetPeers(peers []string) {
+	members := make([]string, 0, len(peers)+1)
+	for _, p := range peers {
+		members = append(members, strings.TrimSuffix(p, "/"))
+	}
+	if !slices.Contains(members, pg.self) {
+		members = append(members, pg.self)
+	}
+	slices.Sort(members)
+	members = slices.Compact(members)
+
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	if slices.Equal(members, pg.peers) {
+		return
+	}
+
+	pg.log.Info("peer group changed", "peers", members)
+	pg.peers = members
+	pg.ring = NewHashRing(ringReplicas, members...)
+}
+
+func (pg *PeerGroup) Owner(key string) string {
+	pg.mu.RLock()
+	defer pg.mu.RUnlock()
+	return pg.ring.Owner(key)
+}
+
+// Forward asks the owner of key for a decision. The second result is false
+// when the decision has to be made locally, either because this instance
+// owns the key, because the owner could not be reached or because it has
+// no limit for the key. The call is given up when ctx is done.
+func (pg *PeerGroup) Forward(ctx context.Context, key string, cost int64) (ratelimit.Result, bool) {
+	owner := pg.Owner(key)
+	if owner == "" || owner == pg.self || pg.isDown(owner) {
+		return ratelimit.Result{}, false
+	}
+
+	body, err := json.Marshal(PeerAllowRequest{Key: key, Cost: cost})
+	if err != nil {
+		pg.log.Error("failed to marshal peer request", "error", err)
+		return ratelimit.Result{}, false
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, owner+PeerAllowPath, bytes.NewReader(body))
+	if err != nil {
+		pg.log.Error("failed to create peer request", "peer", owner, "error", err)
+		return ratelimit.Result{}, false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(PeerSecretHeader, pg.secret)
+
+	resp, err := pg.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			// the caller is gone, which says nothing about the peer
+			return ratelimit.Result{}, false
+		}
+		pg.log.Warn("peer is unreachable, falling back to local decision", "peer", owner, "error", err)
+		pg.markDown(owner)
+		return ratelimit.Result{}, false
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		pg.log.Debug("peer has no limit for key, deciding locally", "peer", owner, "key", key)
+		return ratelimit.Result{}, false
+	default:
+		pg.log.Warn("peer returned unexpected status", "peer", owner, "status", resp.StatusCode)
+		pg.markDown(owner)
+		return ratelimit.Result{}, false
+	}
+
+	var res ratelimit.Result
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		pg.log.Warn("failed to decode peer response", "peer", owner, "error", err)
+		return ratelimit.Result{}, false
+	}
+
+	return res, true
+}
+
+func (pg *PeerGroup) StartDNSDiscovery(ctx context.Context, host, port string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err != nil {
+			pg.log.Error("failed to resolve peers", "host", host, "error", err)
+		} else {
+			peers := make([]string, 0, len(addrs))
+			for _, addr := range addrs {
+				peers = append(peers, fmt.Sprintf("http://%s", net.JoinHostPort(addr, port)))
+			}
+			pg.SetPeers(peers)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (pg *PeerGroup) isDown(peer string) bool {
+	pg.mu.RLock()
+	defer pg.mu.RUnlock()
+	return time.Now().Before(pg.down[peer])
+}
+
+func (pg *PeerGroup) markDown(peer string) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+	pg.down[peer] = time.Now().Add(peerDownPeriod)
+}
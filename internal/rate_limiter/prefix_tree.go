@@ -0,0 +1,82 @@
+package rate_limiter
+
+import (
+	"net/netip"
+	"time"
+)
+
+// prefixTree is a binary radix tree of address prefixes. IPv4 and IPv6
+// prefixes live in separate trees, and each node holds the expiry of the
+// prefix ending there, so that a lookup walks at most 32 or 128 nodes no
+// matter how many prefixes there are.
+type prefixTree struct {
+	v4, v6 *prefixNode
+}
+
+type prefixNode struct {
+	children [2]*prefixNode
+	// set marks a node where a prefix ends, expires is zero for prefixes
+	// that never expire
+	set     bool
+	expires time.Time
+}
+
+func (t *prefixTree) insert(prefix netip.Prefix, expires time.Time) {
+	prefix = prefix.Masked()
+	root := &t.v6
+	if prefix.Addr().Is4() {
+		root = &t.v4
+	}
+	if *root == nil {
+		*root = &prefixNode{}
+	}
+
+	node := *root
+	bytes := prefix.Addr().AsSlice()
+	for i := 0; i < prefix.Bits(); i++ {
+		b := bit(bytes, i)
+		if node.children[b] == nil {
+			node.children[b] = &prefixNode{}
+		}
+		node = node.children[b]
+	}
+
+	// the same prefix may be listed twice, the later expiry wins
+	switch {
+	case !node.set:
+		node.expires = expires
+	case node.expires.IsZero():
+	case expires.IsZero() || expires.After(node.expires):
+		node.expires = expires
+	}
+	node.set = true
+}
+
+// contains reports whether addr is in any prefix that has not expired.
+func (t *prefixTree) contains(addr netip.Addr, now time.Time) bool {
+	if !addr.IsValid() {
+		return false
+	}
+	addr = addr.Unmap()
+
+	node := t.v6
+	if addr.Is4() {
+		node = t.v4
+	}
+
+	bytes := addr.AsSlice()
+	for i := 0; node != nil; i++ {
+		if node.set && (node.expires.IsZero() || now.Before(node.expires)) {
+			return true
+		}
+		if i == addr.BitLen() {
+			break
+		}
+		node = node.children[bit(bytes, i)]
+	}
+	return false
+}
+
+func bit(bytes []byte, i int) int {
+	return int(bytes[i/8]>>(7-i%8)) & 1
+}
@@ -0,0 +1,124 @@
+package rate_limiter
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"ratelimiter/internal/repositories"
+)
+
+const (
+	// usage rows older than staleWindows sync intervals belong to replicas
+	// that are gone or no longer see the key
+	staleWindows  = 5
+	cleanupWindow = time.Minute
+)
+
+// QuotaSyncer splits the configured limit of every key between the replicas
+// in proportion to their observed demand. Each replica admits requests from
+// its local share only, so between two syncs the replicas together may admit
+// slightly more than the global limit.
+type QuotaSyncer struct {
+	log      *slog.Logger
+	store    *BucketStore
+	db       repositories.DBInterface
+	instance string
+	interval time.Duration
+}
+
+func NewQuotaSyncer(log *slog.Logger, store *BucketStore, db repositories.DBInterface, instance string, interval time.Duration) *QuotaSyncer {
+	return &QuotaSyncer{
+		log:      log,
+		store:    store,
+		db:       db,
+		instance: instance,
+		interval: interval,
+	}
+}
+
+func (q *QuotaSyncer) Start(ctx context.Context) {
+	ticker := time.NewTicker(q.interval)
+	defer ticker.Stop()
+
+	lastCleanup := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := q.sync(ctx); err != nil {
+			q.log.Error("failed to sync quota usage", "error", err)
+		}
+
+		if time.Since(lastCleanup) > cleanupWindow {
+			if err := q.db.DeleteStaleUsage(ctx, cleanupWindow); err != nil {
+				q.log.Error("failed to delete stale quota usage", "error", err)
+			}
+			lastCleanup = time.Now()
+		}
+	}
+}
+
+func (q *QuotaSyncer) sync(ctx context.Context) error {
+	usage, tracked := q.store.usage()
+	if len(tracked) == 0 {
+		return nil
+	}
+
+	if len(usage) > 0 {
+		if err := q.db.ReportUsage(ctx, q.instance, usage); err != nil {
+			return err
+		}
+	}
+
+	rows, err := q.db.ListUsage(ctx, tracked, staleWindows*q.interval)
+	if err != nil {
+		return err
+	}
+
+	type demand struct {
+		own       int64
+		reported  bool
+		total     int64
+		instances int64
+	}
+	demands := make(map[string]*demand, len(tracked))
+	for _, row := range rows {
+		d, ok := demands[row.Key]
+		if !ok {
+			d = &demand{}
+			demands[row.Key] = d
+		}
+		if row.Instance == q.instance {
+			d.own = row.Demand
+			d.reported = true
+		}
+		d.total += row.Demand
+		d.instances++
+	}
+
+	for _, key := range tracked {
+		bucket := q.store.Get(key)
+		if bucket == nil {
+			continue
+		}
+		d, ok := demands[key]
+		if !ok {
+			// no replica has seen the key lately, so the whole limit
+			// is free again
+			bucket.SetShare(1)
+			continue
+		}
+		if !d.reported {
+			d.instances++
+		}
+		// every replica is credited one extra request, so that replicas
+		// with little demand keep a small share instead of none at all
+		bucket.SetShare(float64(d.own+1) / float64(d.total+d.instances))
+	}
+
+	return nil
+}
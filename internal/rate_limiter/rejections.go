@@ -0,0 +1,107 @@
+package rate_limiter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"ratelimiter/internal/models"
+	"ratelimiter/pkg/ratelimit"
+)
+
+type rejection struct {
+	status      int
+	contentType string
+	tmpl        interface {
+		Execute(w io.Writer, data any) error
+	}
+}
+
+// NewRejectHandler writes rejections as problem details, unless a route
+// pattern matches the request. The most specific route wins, like with the
+// rules. Route templates get the ratelimit.Problem as data, and a json
+// function to quote values. Templates of HTML and XML content types are
+// html/templates, since the problem holds the path and key of the client.
+func NewRejectHandler(log *slog.Logger, routes []models.RejectionRoute) (func(w http.ResponseWriter, r *http.Request, key string, res ratelimit.Result), error) {
+	mux := http.NewServeMux()
+	byPattern := make(map[string]rejection, len(routes))
+	for i, route := range routes {
+		if err := registerPattern(mux, route.Pattern); err != nil {
+			return nil, fmt.Errorf("rejection route %d: %w", i, err)
+		}
+
+		rej := rejection{status: route.Status, contentType: route.ContentType}
+		if rej.status == 0 {
+			rej.status = http.StatusTooManyRequests
+		}
+		if route.Template != "" {
+			if rej.contentType == "" {
+				rej.contentType = "text/plain; charset=utf-8"
+			}
+			var err error
+			if isMarkup(rej.contentType) {
+				rej.tmpl, err = htmltemplate.New(route.Pattern).Funcs(htmltemplate.FuncMap{"json": toJSON}).Parse(route.Template)
+			} else {
+				rej.tmpl, err = template.New(route.Pattern).Funcs(template.FuncMap{"json": toJSON}).Parse(route.Template)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("rejection route %d: %w", i, err)
+			}
+		}
+		byPattern[route.Pattern] = rej
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, key string, res ratelimit.Result) {
+		p := ratelimit.RateLimitedProblem(r, key, res)
+
+		_, pattern := mux.Handler(r)
+		rej, ok := byPattern[pattern]
+		if !ok {
+			ratelimit.WriteProblem(w, p)
+			return
+		}
+
+		p.Status = rej.status
+		if rej.tmpl == nil {
+			ratelimit.WriteProblem(w, p)
+			return
+		}
+
+		var body bytes.Buffer
+		if err := rej.tmpl.Execute(&body, p); err != nil {
+			log.Error("failed to render rejection template", "pattern", pattern, "error", err)
+			ratelimit.WriteProblem(w, p)
+			return
+		}
+
+		w.Header().Set("Content-Type", rej.contentType)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(rej.status)
+		if _, err := w.Write(body.Bytes()); err != nil {
+			log.Error("Error writing response", "error", err)
+		}
+	}, nil
+}
+
+func toJSON(v any) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// isMarkup reports whether browsers may render content of the given type
+// as a document, so that values have to be escaped.
+func isMarkup(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// an unparsable type is not trusted to be harmless
+		return true
+	}
+	return mediaType == "text/html" || mediaType == "text/xml" || mediaType == "application/xml" || strings.HasSuffix(mediaType, "+xml")
+}
@@ -0,0 +1,52 @@
+package rate_limiter
+
+import (
+	"hash/crc32"
+	"slices"
+	"strconv"
+)
+
+type HashRing struct {
+	replicas int
+	hashes   []uint32
+	nodes    map[uint32]string
+}
+
+func NewHashRing(replicas int, nodes ...string) *HashRing {
+	if replicas <= 0 {
+		replicas = 1
+	}
+
+	r := &HashRing{
+		replicas: replicas,
+		nodes:    make(map[uint32]string, len(nodes)*replicas),
+	}
+
+	for _, node := range nodes {
+		for i := 0; i < replicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + node))
+			if _, exists := r.nodes[h]; exists {
+				continue
+			}
+			r.nodes[h] = node
+			r.hashes = append(r.hashes, h)
+		}
+	}
+	slices.Sort(r.hashes)
+
+	return r
+}
+
+func (r *HashRing) Owner(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+
+	h := crc32.ChecksumIEEE([]byte(key))
+	idx, _ := slices.BinarySearch(r.hashes, h)
+	if idx == len(r.hashes) {
+		idx = 0
+	}
+
+	return r.nodes[r.hashes[idx]]
+}
@@ -0,0 +1,182 @@
+package rate_limiter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"ratelimiter/internal/repositories"
+)
+
+// RuleSet matches requests against the rules stored in the database. Rule
+// patterns are http.ServeMux patterns, so the most specific rule wins.
+type RuleSet struct {
+	log   *slog.Logger
+	db    repositories.DBInterface
+	store *BucketStore
+
+	mu    sync.RWMutex
+	mux   *http.ServeMux
+	rules map[string]repositories.Rule
+}
+
+func NewRuleSet(log *slog.Logger, db repositories.DBInterface, store *BucketStore) *RuleSet {
+	rs := &RuleSet{
+		log:   log,
+		db:    db,
+		store: store,
+		mux:   http.NewServeMux(),
+		rules: make(map[string]repositories.Rule),
+	}
+	store.addSource(ruleKeyPrefix, rs.bucket)
+	return rs
+}
+
+func (rs *RuleSet) Match(r *http.Request) (repositories.Rule, bool) {
+	if rs == nil {
+		return repositories.Rule{}, false
+	}
+
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	_, pattern := rs.mux.Handler(r)
+	rule, ok := rs.rules[pattern]
+	return rule, ok
+}
+
+// Validate checks that pattern is a valid pattern that does not conflict
+// with the patterns of the other rules. id is the rule being updated, or 0
+// for a new one.
+func (rs *RuleSet) Validate(id int64, pattern string) error {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	mux := http.NewServeMux()
+	for _, rule := range rs.rules {
+		if rule.ID != id {
+			mux.Handle(rule.Pattern, http.NotFoundHandler())
+		}
+	}
+	return registerPattern(mux, pattern)
+}
+
+// Load replaces the rules with the ones from the database and drops the
+// buckets of rules that were changed or deleted.
+func (rs *RuleSet) Load(ctx context.Context) error {
+	rules, err := rs.db.ListRules(ctx)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	byPattern := make(map[string]repositories.Rule, len(rules))
+	byID := make(map[int64]repositories.Rule, len(rules))
+	for _, rule := range rules {
+		if err := registerPattern(mux, rule.Pattern); err != nil {
+			rs.log.Error("skipping invalid rule", "id", rule.ID, "pattern", rule.Pattern, "error", err)
+			continue
+		}
+		byPattern[rule.Pattern] = rule
+		byID[rule.ID] = rule
+	}
+
+	rs.mu.Lock()
+	old := rs.rules
+	rs.mux = mux
+	rs.rules = byPattern
+	rs.mu.Unlock()
+
+	for _, rule := range old {
+		if current, ok := byID[rule.ID]; !ok || !sameLimit(current, rule) {
+			rs.store.DeleteFunc(func(key string, _ *TokenBucket) bool {
+				return key == ruleBucketPrefix(rule.ID) || strings.HasPrefix(key, ruleBucketPrefix(rule.ID)+":")
+			})
+		}
+	}
+
+	rs.log.Info("rules loaded", "count", len(byPattern))
+	return nil
+}
+
+func (rs *RuleSet) Channel() string {
+	return repositories.RuleChangesChannel
+}
+
+func (rs *RuleSet) Reload(ctx context.Context) error {
+	return rs.Load(ctx)
+}
+
+func (rs *RuleSet) Apply(ctx context.Context, _ string) error {
+	return rs.Load(ctx)
+}
+
+// RuleBucketKey returns the key of the bucket that a request with the given
+// client key counts against. All clients share the bucket of a global rule.
+func RuleBucketKey(rule repositories.Rule, key string) string {
+	if rule.Scope == repositories.ScopeGlobal {
+		return ruleBucketPrefix(rule.ID)
+	}
+	return ruleBucketPrefix(rule.ID) + ":" + key
+}
+
+const ruleKeyPrefix = "rule:"
+
+func ruleBucketPrefix(id int64) string {
+	return ruleKeyPrefix + strconv.FormatInt(id, 10)
+}
+
+func ruleBucket(store *BucketStore, rule repositories.Rule, bucketKey string) *TokenBucket {
+	return store.getOrCreate(bucketKey, func() *TokenBucket {
+		tb := NewTokenBucket(rule.Capacity, rule.RefillRate, false)
+		tb.mode = rule.Mode
+		tb.evictable = true
+		return tb
+	})
+}
+
+// bucket creates the bucket of a rule key forwarded by a peer, if the rule
+// exists and its scope matches the key.
+func (rs *RuleSet) bucket(_ context.Context, bucketKey string) (*TokenBucket, bool) {
+	idPart, clientKey, perClient := strings.Cut(strings.TrimPrefix(bucketKey, ruleKeyPrefix), ":")
+	id, err := strconv.ParseInt(idPart, 10, 64)
+	if err != nil {
+		return nil, false
+	}
+
+	rs.mu.RLock()
+	var rule repositories.Rule
+	var found bool
+	for _, r := range rs.rules {
+		if r.ID == id {
+			rule, found = r, true
+			break
+		}
+	}
+	rs.mu.RUnlock()
+
+	if !found || perClient != (rule.Scope != repositories.ScopeGlobal) || RuleBucketKey(rule, clientKey) != bucketKey {
+		return nil, false
+	}
+	return ruleBucket(rs.store, rule, bucketKey), true
+}
+
+func sameLimit(a, b repositories.Rule) bool {
+	return a.Capacity == b.Capacity && a.RefillRate == b.RefillRate && a.Scope == b.Scope && a.Mode == b.Mode
+}
+
+// registerPattern reports invalid and conflicting patterns, on which
+// http.ServeMux panics.
+func registerPattern(mux *http.ServeMux, pattern string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	mux.Handle(pattern, http.NotFoundHandler())
+	return nil
+}
@@ -0,0 +1,147 @@
+package rate_limiter
+
+import (
+	"container/list"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"ratelimiter/internal/models"
+	"ratelimiter/pkg/ratelimit"
+)
+
+// maxSizeRejectionKeys bounds the clients whose rejections are counted,
+// the one rejected longest ago is dropped for a new one.
+const maxSizeRejectionKeys = 10_000
+
+// SizeGuard is the ratelimit.SizeGuard of the configured request limits and
+// the limits stored with the clients. It counts the rejected requests of
+// every client by the limit they exceeded.
+type SizeGuard struct {
+	log      *slog.Logger
+	defaults models.SizeLimit
+	store    *BucketStore
+	mux      *http.ServeMux
+	routes   map[string]models.SizeLimit
+
+	mu         sync.Mutex
+	rejections map[string]*list.Element
+	// recent orders the *SizeRejections by their last rejection, the most
+	// recent first
+	recent *list.List
+}
+
+// SizeRejections counts the requests of a client rejected for their size,
+// apart from the ones rejected by a rate limit.
+type SizeRejections struct {
+	Key         string `json:"key"`
+	BodyBytes   int64  `json:"body_bytes"`
+	HeaderCount int64  `json:"header_count"`
+	HeaderBytes int64  `json:"header_bytes"`
+}
+
+// NewSizeGuard reads the limits of clients from the buckets in store, which
+// the client changes keep up to date.
+func NewSizeGuard(log *slog.Logger, cfg models.RequestLimits, store *BucketStore) (*SizeGuard, error) {
+	g := &SizeGuard{
+		log:        log,
+		defaults:   cfg.Default,
+		store:      store,
+		mux:        http.NewServeMux(),
+		routes:     make(map[string]models.SizeLimit, len(cfg.Routes)),
+		rejections: make(map[string]*list.Element),
+		recent:     list.New(),
+	}
+	for i, route := range cfg.Routes {
+		if err := registerPattern(g.mux, route.Pattern); err != nil {
+			return nil, fmt.Errorf("request limits route %d: %w", i, err)
+		}
+		g.routes[route.Pattern] = route.SizeLimit
+	}
+	return g, nil
+}
+
+func (g *SizeGuard) SizeLimits(r *http.Request, key string) ratelimit.SizeLimits {
+	var set []models.SizeLimit
+	if tb := g.store.Get(ClientBucketKey(key)); tb != nil && tb.sizes != (ratelimit.SizeLimits{}) {
+		set = append(set, models.SizeLimit(tb.sizes))
+	}
+	if len(g.routes) > 0 {
+		if _, pattern := g.mux.Handler(r); pattern != "" {
+			set = append(set, g.routes[pattern])
+		}
+	}
+
+	return ratelimit.SizeLimits{
+		MaxBodyBytes:   narrowest(g.defaults.MaxBodyBytes, set, func(l models.SizeLimit) int64 { return l.MaxBodyBytes }),
+		MaxHeaderCount: narrowest(g.defaults.MaxHeaderCount, set, func(l models.SizeLimit) int { return l.MaxHeaderCount }),
+		MaxHeaderBytes: narrowest(g.defaults.MaxHeaderBytes, set, func(l models.SizeLimit) int64 { return l.MaxHeaderBytes }),
+	}
+}
+
+// narrowest returns the smallest field of the limits that set it, or the
+// default if none does.
+func narrowest[T int | int64](def T, limits []models.SizeLimit, field func(models.SizeLimit) T) T {
+	var v T
+	for _, l := range limits {
+		if f := field(l); f > 0 && (v == 0 || f < v) {
+			v = f
+		}
+	}
+	if v == 0 {
+		return def
+	}
+	return v
+}
+
+func (g *SizeGuard) Oversized(r *http.Request, key string, limit string) {
+	g.log.Info("request rejected for its size",
+		"key", key,
+		"method", r.Method,
+		"path", r.URL.Path,
+		"limit", limit,
+	)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var rej *SizeRejections
+	if e, ok := g.rejections[key]; ok {
+		g.recent.MoveToFront(e)
+		rej = e.Value.(*SizeRejections)
+	} else {
+		if len(g.rejections) >= maxSizeRejectionKeys {
+			oldest := g.recent.Remove(g.recent.Back()).(*SizeRejections)
+			delete(g.rejections, oldest.Key)
+		}
+		rej = &SizeRejections{Key: key}
+		g.rejections[key] = g.recent.PushFront(rej)
+	}
+	switch limit {
+	case ratelimit.LimitBodyBytes:
+		rej.BodyBytes++
+	case ratelimit.LimitHeaderCount:
+		rej.HeaderCount++
+	case ratelimit.LimitHeaderBytes:
+		rej.HeaderBytes++
+	}
+}
+
+// Rejections returns the counts of the clients that had a request rejected
+// most recently, sorted by key.
+func (g *SizeGuard) Rejections() []SizeRejections {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	counts := make([]SizeRejections, 0, len(g.rejections))
+	for e := g.recent.Front(); e != nil; e = e.Next() {
+		counts = append(counts, *e.Value.(*SizeRejections))
+	}
+	slices.SortFunc(counts, func(a, b SizeRejections) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	return counts
+}
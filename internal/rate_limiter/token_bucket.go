@@ -1,54 +1,140 @@
 package rate_limiter
 
 import (
-	"sync"
+	"context"
+	"sync/atomic"
 	"time"
+
+	"ratelimiter/internal/repositories"
+	"ratelimiter/pkg/ratelimit"
 )
 
+// TokenBucket is a ratelimit.TokenBucket that may be owned by a peer, in
+// which case the peer makes the decisions.
 type TokenBucket struct {
-	capacity   int64
-	tokens     int64
-	refillRate time.Duration
-	lastRefill time.Time
-	unlimited  bool
-	mu         sync.Mutex
+	*ratelimit.TokenBucket
+	// store and key are set when the bucket is added to a store, whose
+	// peers may make the decisions for key
+	store *BucketStore
+	key   string
+	// fallback marks default buckets of keys without a client, which are
+	// replaced once a client with that key shows up in the database
+	fallback bool
+	// evictable marks buckets created the same way again on the next
+	// request of their key, which may be dropped once they are idle
+	evictable bool
+	// unresolved marks default buckets of keys whose client lookup failed,
+	// the lookup is tried again on their next request
+	unresolved atomic.Bool
+	// mode is one of the repositories.Mode* values, enforce if empty
+	mode             string
+	shadowRejections atomic.Int64
+	// sizes are the request size limits of the client
+	sizes ratelimit.SizeLimits
 }
 
 func NewTokenBucket(capacity int64, refillRate time.Duration, unlimited bool) *TokenBucket {
-	if refillRate <= 0 {
-		refillRate = time.Second
+	return &TokenBucket{
+		TokenBucket: ratelimit.NewTokenBucket(ratelimit.Limit{
+			Capacity:   capacity,
+			RefillRate: refillRate,
+			Unlimited:  unlimited,
+		}),
 	}
+}
 
-	return &TokenBucket{
-		capacity:   capacity,
-		tokens:     capacity,
-		refillRate: refillRate,
-		lastRefill: time.Now(),
-		unlimited:  unlimited,
+// NewClientBucket returns the bucket of a client, in the client's mode and
+// with its size limits.
+func NewClientBucket(client repositories.Client) *TokenBucket {
+	tb := NewTokenBucket(client.Capacity, client.RefillRate, client.Unlimited)
+	tb.mode = client.Mode
+	tb.sizes = clientSizeLimits(client)
+	return tb
+}
+
+func clientSizeLimits(client repositories.Client) ratelimit.SizeLimits {
+	return ratelimit.SizeLimits{
+		MaxBodyBytes:   client.MaxBodyBytes,
+		MaxHeaderCount: client.MaxHeaderCount,
+		MaxHeaderBytes: client.MaxHeaderBytes,
 	}
 }
 
 func (tb *TokenBucket) Allow() bool {
-	tb.mu.Lock()
-	defer tb.mu.Unlock()
+	return tb.Take().Allowed
+}
 
-	if tb.unlimited {
-		return true
-	}
+func (tb *TokenBucket) Take() ratelimit.Result {
+	return tb.TakeN(1)
+}
+
+func (tb *TokenBucket) TakeN(cost int64) ratelimit.Result {
+	return tb.TakeNContext(context.Background(), cost)
+}
 
-	now := time.Now()
-	elapsed := now.Sub(tb.lastRefill)
-	newTokens := int64(elapsed / tb.refillRate)
+// TakeNContext takes cost tokens at once, or none if there are fewer left.
+// A decision forwarded to a peer is given up when ctx is done. In shadow
+// mode the result is always allowed, and the would-be rejections are
+// counted.
+func (tb *TokenBucket) TakeNContext(ctx context.Context, cost int64) ratelimit.Result {
+	if tb.mode == repositories.ModeOff {
+		return ratelimit.Result{Allowed: true, Unlimited: true}
+	}
 
-	if newTokens > 0 {
-		tb.tokens = min(tb.capacity, tb.tokens+newTokens)
-		tb.lastRefill = now
+	res, ok := ratelimit.Result{}, false
+	if tb.store != nil && !tb.Limit().Unlimited {
+		res, ok = tb.store.forward(ctx, tb.key, cost)
+	}
+	if !ok {
+		res = tb.takeLocal(cost)
 	}
 
-	if tb.tokens > 0 {
-		tb.tokens--
-		return true
+	if tb.mode == repositories.ModeShadow && !res.Unlimited {
+		res.Shadow = true
+		if !res.Allowed {
+			res.Allowed = true
+			res.WouldReject = true
+			tb.shadowRejections.Add(1)
+		}
 	}
+	return res
+}
+
+func (tb *TokenBucket) takeLocal(cost int64) ratelimit.Result {
+	return tb.TokenBucket.TakeN(cost)
+}
+
+// idle reports whether the bucket is as full as a new one.
+func (tb *TokenBucket) idle() bool {
+	st := tb.TokenBucket.State()
+	return !st.Unlimited && st.Tokens >= st.Capacity
+}
+
+type BucketState struct {
+	ratelimit.BucketState
+	Fallback         bool
+	Mode             string
+	ShadowRejections int64
+}
 
-	return false
+func (tb *TokenBucket) State() BucketState {
+	return tb.withMode(tb.TokenBucket.State())
+}
+
+// Reset refills the bucket to its capacity, or empties it if drain is set.
+func (tb *TokenBucket) Reset(drain bool) BucketState {
+	return tb.withMode(tb.TokenBucket.Reset(drain))
+}
+
+func (tb *TokenBucket) withMode(state ratelimit.BucketState) BucketState {
+	mode := tb.mode
+	if mode == "" {
+		mode = repositories.ModeEnforce
+	}
+	return BucketState{
+		BucketState:      state,
+		Fallback:         tb.fallback,
+		Mode:             mode,
+		ShadowRejections: tb.shadowRejections.Load(),
+	}
 }
@@ -0,0 +1,146 @@
+package rate_limiter
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"strings"
+
+	"ratelimiter/internal/repositories"
+	"ratelimiter/pkg/ratelimit"
+)
+
+// ChangeHandler keeps some in-memory state in sync with a table that
+// announces its changes on a notification channel.
+type ChangeHandler interface {
+	Channel() string
+	// Reload rebuilds the whole state, it is called when notifications
+	// may have been missed.
+	Reload(ctx context.Context) error
+	Apply(ctx context.Context, payload string) error
+}
+
+// Watch applies the changes made by any instance to the handlers until ctx
+// is done.
+func Watch(ctx context.Context, log *slog.Logger, db repositories.DBInterface, handlers ...ChangeHandler) {
+	byChannel := make(map[string]ChangeHandler, len(handlers))
+	channels := make([]string, 0, len(handlers))
+	for _, h := range handlers {
+		byChannel[h.Channel()] = h
+		channels = append(channels, h.Channel())
+	}
+
+	// the state is reloaded whenever listening starts, the first time as
+	// well, since changes made between the initial load and LISTEN are
+	// not announced to this instance
+	db.Listen(ctx, channels, func(resync bool) {
+		for _, h := range handlers {
+			if err := h.Reload(ctx); err != nil {
+				log.Error("failed to reload after listening", "channel", h.Channel(), "reconnect", resync, "error", err)
+			}
+		}
+	}, func(channel, payload string) {
+		h, ok := byChannel[channel]
+		if !ok {
+			return
+		}
+		if err := h.Apply(ctx, payload); err != nil {
+			log.Error("failed to apply change", "channel", channel, "payload", payload, "error", err)
+		}
+	})
+}
+
+func LoadClients(ctx context.Context, log *slog.Logger, db repositories.DBInterface, store *BucketStore) error {
+	clients, err := db.ListClients(ctx)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]bool, len(clients))
+	for _, cl := range clients {
+		keys[ClientBucketKey(cl.Key)] = true
+		log.Info("Loading client from DB into BucketStore",
+			"key", cl.Key,
+			"capacity", cl.Capacity,
+			"refill_rate", cl.RefillRate.String(),
+			"unlimited", cl.Unlimited,
+			"mode", cl.Mode,
+		)
+
+		store.Update(cl, ratelimit.PreserveTokens)
+	}
+
+	// clients deleted while notifications were missed, default buckets
+	// are not clients' and stay
+	store.DeleteFunc(func(key string, bucket *TokenBucket) bool {
+		if !strings.HasPrefix(key, clientBucketPrefix) || bucket.fallback || keys[key] {
+			return false
+		}
+		log.Info("Dropping bucket of client no longer in DB", "key", key)
+		return true
+	})
+
+	return nil
+}
+
+// NewOrigin returns a random name of this instance, which tells the changes
+// it made itself apart from the ones of other instances.
+func NewOrigin() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+type clientChanges struct {
+	log    *slog.Logger
+	db     repositories.DBInterface
+	store  *BucketStore
+	origin string
+}
+
+// ClientChanges rebuilds or drops the bucket of a client whenever the client
+// is changed. Updates made by origin, this instance, have been applied
+// already.
+func ClientChanges(log *slog.Logger, db repositories.DBInterface, store *BucketStore, origin string) ChangeHandler {
+	return &clientChanges{log: log, db: db, store: store, origin: origin}
+}
+
+func (c *clientChanges) Channel() string {
+	return repositories.ClientChangesChannel
+}
+
+func (c *clientChanges) Reload(ctx context.Context) error {
+	return LoadClients(ctx, c.log, c.db, c.store)
+}
+
+func (c *clientChanges) Apply(_ context.Context, payload string) error {
+	change, err := repositories.ParseClientChange(payload)
+	if err != nil {
+		return err
+	}
+
+	switch change.Op {
+	case repositories.ClientInserted:
+		c.log.Info("Rebuilding bucket after client change", "op", change.Op, "key", change.Key)
+		c.store.Set(ClientBucketKey(change.Key), NewClientBucket(change.Client()))
+	case repositories.ClientUpdated:
+		// the instance that made the update applied its token policy
+		// already, applying it again would refill a reset bucket twice
+		if change.Origin != "" && change.Origin == c.origin {
+			return nil
+		}
+		policy := ratelimit.TokenPolicy(change.Tokens)
+		switch policy {
+		case ratelimit.PreserveTokens, ratelimit.ScaleTokens, ratelimit.ResetTokens:
+		default:
+			policy = ratelimit.PreserveTokens
+		}
+		c.log.Info("Updating bucket after client change", "op", change.Op, "key", change.Key, "tokens", policy)
+		c.store.Update(change.Client(), policy)
+	case repositories.ClientDeleted:
+		c.log.Info("Dropping bucket of deleted client", "key", change.Key)
+		c.store.Delete(ClientBucketKey(change.Key))
+	}
+	return nil
+}
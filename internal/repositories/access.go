@@ -0,0 +1,159 @@
+package repositories
+
+import (
+	"context"
+	"net/netip"
+	"time"
+
+	apperrors "ratelimiter/pkg/errors"
+)
+
+const (
+	AllowList = "allow"
+	DenyList  = "deny"
+)
+
+// AccessEntry matches clients either by address, with CIDR, or by key, with
+// KeyPattern, where * matches any run of characters. Entries with a zero
+// ExpiresAt never expire.
+type AccessEntry struct {
+	ID         int64        `json:"id"`
+	List       string       `json:"list"`
+	CIDR       netip.Prefix `json:"cidr"`
+	KeyPattern string       `json:"key_pattern"`
+	Comment    string       `json:"comment"`
+	ExpiresAt  time.Time    `json:"expires_at"`
+	CreatedAt  time.Time    `json:"created_at"`
+}
+
+func (db *DB) AddAccessEntry(ctx context.Context, entry AccessEntry) (AccessEntry, error) {
+	db.Log.Debug("Started adding access entry to DB", "list", entry.List)
+
+	query := `
+        INSERT INTO access_entries (list, cidr, key_pattern, comment, expires_at, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        RETURNING id
+    `
+
+	err := db.Conn.QueryRow(ctx, query,
+		entry.List,
+		nullPrefix(entry.CIDR),
+		nullString(entry.KeyPattern),
+		entry.Comment,
+		nullTime(entry.ExpiresAt),
+		entry.CreatedAt,
+	).Scan(&entry.ID)
+
+	if err != nil {
+		db.Log.Error("Failed to add access entry", "error", err)
+		return AccessEntry{}, err
+	}
+
+	db.Log.Debug("Ended adding access entry to DB", "id", entry.ID)
+	return entry, nil
+}
+
+// ListAccessEntries returns the entries of both lists that have not expired.
+func (db *DB) ListAccessEntries(ctx context.Context) ([]AccessEntry, error) {
+	db.Log.Debug("Started listing access entries from DB")
+
+	query := `
+        SELECT id, list, cidr, key_pattern, comment, expires_at, created_at
+        FROM access_entries
+        WHERE expires_at IS NULL OR expires_at > NOW()
+        ORDER BY id
+    `
+
+	rows, err := db.Conn.Query(ctx, query)
+	if err != nil {
+		db.Log.Error("Failed to list access entries", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AccessEntry
+	for rows.Next() {
+		var (
+			entry      AccessEntry
+			cidr       *netip.Prefix
+			keyPattern *string
+			expiresAt  *time.Time
+		)
+		err := rows.Scan(
+			&entry.ID,
+			&entry.List,
+			&cidr,
+			&keyPattern,
+			&entry.Comment,
+			&expiresAt,
+			&entry.CreatedAt,
+		)
+		if err != nil {
+			db.Log.Error("Failed to scan access entry row", "error", err)
+			return nil, err
+		}
+
+		if cidr != nil {
+			entry.CIDR = *cidr
+		}
+		if keyPattern != nil {
+			entry.KeyPattern = *keyPattern
+		}
+		if expiresAt != nil {
+			entry.ExpiresAt = *expiresAt
+		}
+		entries = append(entries, entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		db.Log.Error("Error while iterating over access entry rows", "error", err)
+		return nil, err
+	}
+
+	db.Log.Debug("Ended listing access entries from DB")
+	return entries, nil
+}
+
+func (db *DB) DeleteAccessEntry(ctx context.Context, list string, id int64) error {
+	db.Log.Debug("Started deleting access entry from DB", "list", list, "id", id)
+
+	query := `
+        DELETE FROM access_entries
+        WHERE list = $1 AND id = $2
+    `
+
+	result, err := db.Conn.Exec(ctx, query, list, id)
+	if err != nil {
+		db.Log.Error("Failed to delete access entry", "error", err)
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		db.Log.Warn("No access entry found with the given id", "list", list, "id", id)
+		return apperrors.ErrNotFound
+	}
+
+	db.Log.Debug("Ended deleting access entry from DB")
+	return nil
+}
+
+func nullPrefix(p netip.Prefix) *netip.Prefix {
+	if !p.IsValid() {
+		return nil
+	}
+	return &p
+}
+
+func nullString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func nullTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
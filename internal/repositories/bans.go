@@ -0,0 +1,169 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	apperrors "ratelimiter/pkg/errors"
+)
+
+// Ban keeps a client key out until BannedUntil. Offenses counts the bans in
+// a row, each one lasting twice as long as the one before.
+type Ban struct {
+	Key         string    `json:"key"`
+	Offenses    int       `json:"offenses"`
+	Reason      string    `json:"reason"`
+	BannedUntil time.Time `json:"banned_until"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// AddBan bans key for base, doubled for every earlier offense up to maxBan.
+// Offenses are forgotten once the last ban has been over for forget. A key
+// that is banned already keeps its ban, so that replicas banning the same
+// key at once escalate it only once.
+func (db *DB) AddBan(ctx context.Context, key, reason string, base, maxBan, forget time.Duration) (Ban, error) {
+	db.Log.Debug("Started adding ban to DB", "key", key)
+
+	query := `
+        INSERT INTO bans AS b (key, offenses, reason, banned_until)
+        VALUES ($1, 1, $2, NOW() + make_interval(secs => LEAST($3::float8, $4::float8)))
+        ON CONFLICT (key) DO UPDATE SET
+            offenses = CASE
+                WHEN b.banned_until > NOW() - make_interval(secs => $5::float8) THEN b.offenses + 1
+                ELSE 1
+            END,
+            banned_until = NOW() + make_interval(secs => LEAST($4::float8, $3::float8 * power(2, CASE
+                WHEN b.banned_until > NOW() - make_interval(secs => $5::float8) THEN b.offenses
+                ELSE 0
+            END))),
+            reason = EXCLUDED.reason,
+            updated_at = NOW()
+        WHERE b.banned_until <= NOW()
+        RETURNING key, offenses, reason, banned_until, created_at, updated_at
+    `
+
+	var ban Ban
+	err := db.Conn.QueryRow(ctx, query, key, reason, base.Seconds(), maxBan.Seconds(), forget.Seconds()).Scan(
+		&ban.Key,
+		&ban.Offenses,
+		&ban.Reason,
+		&ban.BannedUntil,
+		&ban.CreatedAt,
+		&ban.UpdatedAt,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		db.Log.Debug("Key is banned already", "key", key)
+		return db.GetBan(ctx, key)
+	}
+	if err != nil {
+		db.Log.Error("Failed to add ban", "error", err)
+		return Ban{}, err
+	}
+
+	db.Log.Debug("Ended adding ban to DB", "key", key, "offenses", ban.Offenses)
+	return ban, nil
+}
+
+func (db *DB) GetBan(ctx context.Context, key string) (Ban, error) {
+	db.Log.Debug("Started getting ban from DB", "key", key)
+
+	query := `
+        SELECT key, offenses, reason, banned_until, created_at, updated_at
+        FROM bans
+        WHERE key = $1
+    `
+
+	var ban Ban
+	err := db.Conn.QueryRow(ctx, query, key).Scan(
+		&ban.Key,
+		&ban.Offenses,
+		&ban.Reason,
+		&ban.BannedUntil,
+		&ban.CreatedAt,
+		&ban.UpdatedAt,
+	)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Ban{}, apperrors.ErrNotFound
+	}
+	if err != nil {
+		db.Log.Error("Failed to get ban", "error", err)
+		return Ban{}, err
+	}
+
+	db.Log.Debug("Ended getting ban from DB")
+	return ban, nil
+}
+
+// ListBans returns the bans that are in effect.
+func (db *DB) ListBans(ctx context.Context) ([]Ban, error) {
+	db.Log.Debug("Started listing bans from DB")
+
+	query := `
+        SELECT key, offenses, reason, banned_until, created_at, updated_at
+        FROM bans
+        WHERE banned_until > NOW()
+        ORDER BY banned_until
+    `
+
+	rows, err := db.Conn.Query(ctx, query)
+	if err != nil {
+		db.Log.Error("Failed to list bans", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bans []Ban
+	for rows.Next() {
+		var ban Ban
+		err := rows.Scan(
+			&ban.Key,
+			&ban.Offenses,
+			&ban.Reason,
+			&ban.BannedUntil,
+			&ban.CreatedAt,
+			&ban.UpdatedAt,
+		)
+		if err != nil {
+			db.Log.Error("Failed to scan ban row", "error", err)
+			return nil, err
+		}
+		bans = append(bans, ban)
+	}
+
+	if err := rows.Err(); err != nil {
+		db.Log.Error("Error while iterating over ban rows", "error", err)
+		return nil, err
+	}
+
+	db.Log.Debug("Ended listing bans from DB")
+	return bans, nil
+}
+
+// LiftBan ends the ban of key and forgets its offenses.
+func (db *DB) LiftBan(ctx context.Context, key string) error {
+	db.Log.Debug("Started lifting ban in DB", "key", key)
+
+	query := `
+        DELETE FROM bans
+        WHERE key = $1
+    `
+
+	result, err := db.Conn.Exec(ctx, query, key)
+	if err != nil {
+		db.Log.Error("Failed to lift ban", "error", err)
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		db.Log.Warn("No ban found with the given key", "key", key)
+		return apperrors.ErrNotFound
+	}
+
+	db.Log.Debug("Ended lifting ban in DB")
+	return nil
+}
@@ -0,0 +1,116 @@
+package repositories
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	ClientChangesChannel = "client_changes"
+	RuleChangesChannel   = "rule_changes"
+	AccessChangesChannel = "access_list_changes"
+	BanChangesChannel    = "ban_changes"
+
+	ClientInserted = "INSERT"
+	ClientUpdated  = "UPDATE"
+	ClientDeleted  = "DELETE"
+
+	BanLifted = "DELETE"
+
+	minReconnectDelay = 100 * time.Millisecond
+	maxReconnectDelay = 30 * time.Second
+)
+
+type ClientChange struct {
+	Op             string        `json:"op"`
+	Key            string        `json:"key"`
+	Capacity       int64         `json:"capacity"`
+	RefillRate     time.Duration `json:"refill_rate"`
+	Unlimited      bool          `json:"unlimited"`
+	Mode           string        `json:"mode"`
+	MaxBodyBytes   int64         `json:"max_body_bytes"`
+	MaxHeaderCount int           `json:"max_header_count"`
+	MaxHeaderBytes int64         `json:"max_header_bytes"`
+	// Tokens is the ratelimit.TokenPolicy of an update and Origin the
+	// instance that made it, both empty if the client was changed otherwise
+	Tokens string `json:"tokens"`
+	Origin string `json:"origin"`
+}
+
+func ParseClientChange(payload string) (ClientChange, error) {
+	var change ClientChange
+	err := json.Unmarshal([]byte(payload), &change)
+	return change, err
+}
+
+func (c ClientChange) Client() Client {
+	return Client{
+		Key:            c.Key,
+		Capacity:       c.Capacity,
+		RefillRate:     c.RefillRate,
+		Unlimited:      c.Unlimited,
+		Mode:           c.Mode,
+		MaxBodyBytes:   c.MaxBodyBytes,
+		MaxHeaderCount: c.MaxHeaderCount,
+		MaxHeaderBytes: c.MaxHeaderBytes,
+	}
+}
+
+// Listen calls handle for every notification on the given channels until
+// ctx is done, reconnecting whenever the connection drops. onListen is called
+// each time listening starts, with resync set after a reconnect, since
+// notifications sent while the listener was disconnected are lost.
+func (db *DB) Listen(ctx context.Context, channels []string, onListen func(resync bool), handle func(channel, payload string)) {
+	delay := minReconnectDelay
+	connected := false
+
+	for ctx.Err() == nil {
+		err := db.listen(ctx, channels, func() {
+			onListen(connected)
+			connected = true
+			delay = minReconnectDelay
+		}, handle)
+		if ctx.Err() != nil {
+			return
+		}
+
+		db.Log.Error("listener disconnected", "error", err, "retry_in", delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, maxReconnectDelay)
+	}
+}
+
+func (db *DB) listen(ctx context.Context, channels []string, onListen func(), handle func(channel, payload string)) error {
+	pooled, err := db.Conn.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	// the connection keeps the LISTEN state, so it must not go back to the pool
+	conn := pooled.Hijack()
+	defer conn.Close(context.Background())
+
+	for _, channel := range channels {
+		if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+			return err
+		}
+	}
+	db.Log.Info("listening for changes", "channels", channels)
+	onListen()
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		db.Log.Debug("received notification", "channel", notification.Channel, "payload", notification.Payload)
+		handle(notification.Channel, notification.Payload)
+	}
+}
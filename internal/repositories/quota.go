@@ -0,0 +1,100 @@
+package repositories
+
+import (
+	"context"
+	"time"
+)
+
+type QuotaUsage struct {
+	Key       string    `json:"key"`
+	Instance  string    `json:"instance"`
+	Demand    int64     `json:"demand"`
+	Admitted  int64     `json:"admitted"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (db *DB) ReportUsage(ctx context.Context, instance string, usage []QuotaUsage) error {
+	db.Log.Debug("Started reporting quota usage to DB", "instance", instance, "keys", len(usage))
+
+	keys := make([]string, 0, len(usage))
+	demand := make([]int64, 0, len(usage))
+	admitted := make([]int64, 0, len(usage))
+	for _, u := range usage {
+		keys = append(keys, u.Key)
+		demand = append(demand, u.Demand)
+		admitted = append(admitted, u.Admitted)
+	}
+
+	query := `
+        INSERT INTO quota_usage (key, instance, demand, admitted, updated_at)
+        SELECT u.key, $1, u.demand, u.admitted, NOW()
+        FROM unnest($2::text[], $3::bigint[], $4::bigint[]) AS u(key, demand, admitted)
+        ON CONFLICT (key, instance) DO UPDATE
+        SET
+            demand = EXCLUDED.demand,
+            admitted = EXCLUDED.admitted,
+            updated_at = EXCLUDED.updated_at
+    `
+
+	_, err := db.Conn.Exec(ctx, query, instance, keys, demand, admitted)
+	if err != nil {
+		db.Log.Error("Failed to report quota usage", "error", err)
+		return err
+	}
+
+	db.Log.Debug("Ended reporting quota usage to DB")
+	return nil
+}
+
+func (db *DB) ListUsage(ctx context.Context, keys []string, maxAge time.Duration) ([]QuotaUsage, error) {
+	db.Log.Debug("Started listing quota usage from DB", "keys", len(keys))
+
+	query := `
+        SELECT key, instance, demand, admitted, updated_at
+        FROM quota_usage
+        WHERE key = ANY($1) AND updated_at > NOW() - $2::interval
+    `
+
+	rows, err := db.Conn.Query(ctx, query, keys, maxAge)
+	if err != nil {
+		db.Log.Error("Failed to list quota usage", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var usage []QuotaUsage
+	for rows.Next() {
+		var u QuotaUsage
+		if err := rows.Scan(&u.Key, &u.Instance, &u.Demand, &u.Admitted, &u.UpdatedAt); err != nil {
+			db.Log.Error("Failed to scan quota usage row", "error", err)
+			return nil, err
+		}
+		usage = append(usage, u)
+	}
+
+	if err := rows.Err(); err != nil {
+		db.Log.Error("Error while iterating over quota usage rows", "error", err)
+		return nil, err
+	}
+
+	db.Log.Debug("Ended listing quota usage from DB")
+	return usage, nil
+}
+
+func (db *DB) DeleteStaleUsage(ctx context.Context, maxAge time.Duration) error {
+	db.Log.Debug("Started deleting stale quota usage from DB")
+
+	query := `
+        DELETE FROM quota_usage
+        WHERE updated_at < NOW() - $1::interval
+    `
+
+	result, err := db.Conn.Exec(ctx, query, maxAge)
+	if err != nil {
+		db.Log.Error("Failed to delete stale quota usage", "error", err)
+		return err
+	}
+
+	db.Log.Debug("Ended deleting stale quota usage from DB", "deleted", result.RowsAffected())
+	return nil
+}
@@ -0,0 +1,201 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	apperrors "ratelimiter/pkg/errors"
+)
+
+const (
+	ScopeClient = "client"
+	ScopeGlobal = "global"
+
+	// ModeEnforce rejects requests over the limit, ModeShadow only reports
+	// them and ModeOff does not check the limit at all.
+	ModeEnforce = "enforce"
+	ModeShadow  = "shadow"
+	ModeOff     = "off"
+)
+
+type Rule struct {
+	ID         int64         `json:"id"`
+	Pattern    string        `json:"pattern"`
+	Capacity   int64         `json:"capacity"`
+	RefillRate time.Duration `json:"refill_rate"`
+	Scope      string        `json:"scope"`
+	Mode       string        `json:"mode"`
+	CreatedAt  time.Time     `json:"created_at"`
+}
+
+func (db *DB) AddRule(ctx context.Context, rule Rule) (Rule, error) {
+	db.Log.Debug("Started adding rule to DB", "pattern", rule.Pattern)
+
+	query := `
+        INSERT INTO rules (pattern, capacity, refill_rate, scope, mode, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        RETURNING id
+    `
+
+	rule.Mode = modeOrDefault(rule.Mode)
+	err := db.Conn.QueryRow(ctx, query,
+		rule.Pattern,
+		rule.Capacity,
+		rule.RefillRate,
+		rule.Scope,
+		rule.Mode,
+		rule.CreatedAt,
+	).Scan(&rule.ID)
+
+	if err != nil {
+		db.Log.Error("Failed to add rule", "error", err)
+		return Rule{}, err
+	}
+
+	db.Log.Debug("Ended adding rule to DB", "id", rule.ID)
+	return rule, nil
+}
+
+func (db *DB) UpdateRule(ctx context.Context, rule Rule) error {
+	db.Log.Debug("Started updating rule in DB", "id", rule.ID)
+
+	query := `
+        UPDATE rules
+        SET
+            pattern = $1,
+            capacity = $2,
+            refill_rate = $3,
+            scope = $4,
+            mode = $5
+        WHERE id = $6
+    `
+
+	result, err := db.Conn.Exec(ctx, query,
+		rule.Pattern,
+		rule.Capacity,
+		rule.RefillRate,
+		rule.Scope,
+		modeOrDefault(rule.Mode),
+		rule.ID,
+	)
+	if err != nil {
+		db.Log.Error("Failed to update rule", "error", err)
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return apperrors.ErrNotFound
+	}
+
+	db.Log.Debug("Ended updating rule in DB")
+	return nil
+}
+
+func (db *DB) GetRule(ctx context.Context, id int64) (Rule, error) {
+	db.Log.Debug("Started getting rule from DB", "id", id)
+
+	query := `
+        SELECT id, pattern, capacity, refill_rate, scope, mode, created_at
+        FROM rules
+        WHERE id = $1
+    `
+
+	var rule Rule
+	err := db.Conn.QueryRow(ctx, query, id).Scan(
+		&rule.ID,
+		&rule.Pattern,
+		&rule.Capacity,
+		&rule.RefillRate,
+		&rule.Scope,
+		&rule.Mode,
+		&rule.CreatedAt,
+	)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Rule{}, apperrors.ErrNotFound
+	}
+	if err != nil {
+		db.Log.Error("Failed to get rule", "error", err)
+		return Rule{}, err
+	}
+
+	db.Log.Debug("Ended getting rule from DB")
+	return rule, nil
+}
+
+func (db *DB) ListRules(ctx context.Context) ([]Rule, error) {
+	db.Log.Debug("Started listing rules from DB")
+
+	query := `
+        SELECT id, pattern, capacity, refill_rate, scope, mode, created_at
+        FROM rules
+        ORDER BY id
+    `
+
+	rows, err := db.Conn.Query(ctx, query)
+	if err != nil {
+		db.Log.Error("Failed to list rules", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []Rule
+	for rows.Next() {
+		var rule Rule
+		err := rows.Scan(
+			&rule.ID,
+			&rule.Pattern,
+			&rule.Capacity,
+			&rule.RefillRate,
+			&rule.Scope,
+			&rule.Mode,
+			&rule.CreatedAt,
+		)
+		if err != nil {
+			db.Log.Error("Failed to scan rule row", "error", err)
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	if err := rows.Err(); err != nil {
+		db.Log.Error("Error while iterating over rule rows", "error", err)
+		return nil, err
+	}
+
+	db.Log.Debug("Ended listing rules from DB")
+	return rules, nil
+}
+
+func (db *DB) DeleteRule(ctx context.Context, id int64) error {
+	db.Log.Debug("Started deleting rule from DB", "id", id)
+
+	query := `
+        DELETE FROM rules
+        WHERE id = $1
+    `
+
+	result, err := db.Conn.Exec(ctx, query, id)
+	if err != nil {
+		db.Log.Error("Failed to delete rule", "error", err)
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		db.Log.Warn("No rule found with the given id", "id", id)
+		return apperrors.ErrNotFound
+	}
+
+	db.Log.Debug("Ended deleting rule from DB")
+	return nil
+}
+
+func modeOrDefault(mode string) string {
+	if mode == "" {
+		return ModeEnforce
+	}
+	return mode
+}
@@ -14,7 +14,12 @@ type Client struct {
 	Capacity   int64         `json:"capacity"`
 	RefillRate time.Duration `json:"refill_rate"`
 	Unlimited  bool          `json:"unlimited"`
-	CreatedAt  time.Time     `json:"created_at"`
+	Mode       string        `json:"mode"`
+	// the request size limits of the client, zero ones are not limited
+	MaxBodyBytes   int64     `json:"max_body_bytes"`
+	MaxHeaderCount int       `json:"max_header_count"`
+	MaxHeaderBytes int64     `json:"max_header_bytes"`
+	CreatedAt      time.Time `json:"created_at"`
 }
 
 type DBInterface interface {
@@ -22,7 +27,27 @@ type DBInterface interface {
 	GetClient(ctx context.Context, key string) (Client, error)
 	ListClients(ctx context.Context) ([]Client, error)
 	DeleteClient(ctx context.Context, key string) error
-	UpdateClient(ctx context.Context, client Client) error
+	UpdateClient(ctx context.Context, client Client, origin, tokens string) error
+	Listen(ctx context.Context, channels []string, onListen func(resync bool), handle func(channel, payload string))
+
+	AddRule(ctx context.Context, rule Rule) (Rule, error)
+	GetRule(ctx context.Context, id int64) (Rule, error)
+	ListRules(ctx context.Context) ([]Rule, error)
+	UpdateRule(ctx context.Context, rule Rule) error
+	DeleteRule(ctx context.Context, id int64) error
+
+	AddAccessEntry(ctx context.Context, entry AccessEntry) (AccessEntry, error)
+	ListAccessEntries(ctx context.Context) ([]AccessEntry, error)
+	DeleteAccessEntry(ctx context.Context, list string, id int64) error
+
+	AddBan(ctx context.Context, key, reason string, base, maxBan, forget time.Duration) (Ban, error)
+	GetBan(ctx context.Context, key string) (Ban, error)
+	ListBans(ctx context.Context) ([]Ban, error)
+	LiftBan(ctx context.Context, key string) error
+
+	ReportUsage(ctx context.Context, instance string, usage []QuotaUsage) error
+	ListUsage(ctx context.Context, keys []string, maxAge time.Duration) ([]QuotaUsage, error)
+	DeleteStaleUsage(ctx context.Context, maxAge time.Duration) error
 }
 
 type DB struct {
@@ -56,8 +81,8 @@ func (db *DB) AddClient(ctx context.Context, client Client) error {
 	db.Log.Debug("Started adding client to DB")
 
 	query := `
-        INSERT INTO clients (key, capacity, refill_rate, unlimited, created_at)
-        VALUES ($1, $2, $3, $4, $5)
+        INSERT INTO clients (key, capacity, refill_rate, unlimited, mode, max_body_bytes, max_header_count, max_header_bytes, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
     `
 
 	_, err := db.Conn.Exec(ctx, query,
@@ -65,6 +90,10 @@ func (db *DB) AddClient(ctx context.Context, client Client) error {
 		client.Capacity,
 		client.RefillRate,
 		client.Unlimited,
+		modeOrDefault(client.Mode),
+		client.MaxBodyBytes,
+		client.MaxHeaderCount,
+		client.MaxHeaderBytes,
 		client.CreatedAt,
 	)
 
@@ -77,30 +106,59 @@ func (db *DB) AddClient(ctx context.Context, client Client) error {
 	return nil
 }
 
-func (db *DB) UpdateClient(ctx context.Context, client Client) error {
+// UpdateClient changes client. origin names the instance making the change
+// and tokens is the ratelimit.TokenPolicy of it, both are sent along in the
+// change notification so that every other instance applies the policy to
+// its bucket.
+func (db *DB) UpdateClient(ctx context.Context, client Client, origin, tokens string) error {
 	db.Log.Debug("Started updating client in DB", "key", client.Key)
 
+	tx, err := db.Conn.Begin(ctx)
+	if err != nil {
+		db.Log.Error("Failed to begin client update", "error", err)
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// the trigger reads them, set for this transaction only
+	if _, err := tx.Exec(ctx, `SELECT set_config('ratelimiter.origin', $1, true), set_config('ratelimiter.token_policy', $2, true)`, origin, tokens); err != nil {
+		db.Log.Error("Failed to set token policy", "error", err)
+		return err
+	}
+
 	query := `
         UPDATE clients
         SET 
             capacity = $1,
             refill_rate = $2,
-            unlimited = $3
-        WHERE key = $4
-        RETURNING key, capacity, refill_rate, unlimited, created_at
+            unlimited = $3,
+            mode = $4,
+            max_body_bytes = $5,
+            max_header_count = $6,
+            max_header_bytes = $7
+        WHERE key = $8
+        RETURNING key, capacity, refill_rate, unlimited, mode, max_body_bytes, max_header_count, max_header_bytes, created_at
     `
 
 	var updated Client
-	err := db.Conn.QueryRow(ctx, query,
+	err = tx.QueryRow(ctx, query,
 		client.Capacity,
 		client.RefillRate,
 		client.Unlimited,
+		modeOrDefault(client.Mode),
+		client.MaxBodyBytes,
+		client.MaxHeaderCount,
+		client.MaxHeaderBytes,
 		client.Key,
 	).Scan(
 		&updated.Key,
 		&updated.Capacity,
 		&updated.RefillRate,
 		&updated.Unlimited,
+		&updated.Mode,
+		&updated.MaxBodyBytes,
+		&updated.MaxHeaderCount,
+		&updated.MaxHeaderBytes,
 		&updated.CreatedAt,
 	)
 
@@ -109,6 +167,11 @@ func (db *DB) UpdateClient(ctx context.Context, client Client) error {
 		return err
 	}
 
+	if err := tx.Commit(ctx); err != nil {
+		db.Log.Error("Failed to commit client update", "error", err)
+		return err
+	}
+
 	db.Log.Debug("Ended updating client in DB")
 	return nil
 }
@@ -119,7 +182,7 @@ func (db *DB) GetClient(ctx context.Context, key string) (Client, error) {
 	var client Client
 
 	query := `
-        SELECT key, capacity, refill_rate, unlimited, created_at
+        SELECT key, capacity, refill_rate, unlimited, mode, max_body_bytes, max_header_count, max_header_bytes, created_at
         FROM clients
         WHERE key = $1
     `
@@ -129,6 +192,10 @@ func (db *DB) GetClient(ctx context.Context, key string) (Client, error) {
 		&client.Capacity,
 		&client.RefillRate,
 		&client.Unlimited,
+		&client.Mode,
+		&client.MaxBodyBytes,
+		&client.MaxHeaderCount,
+		&client.MaxHeaderBytes,
 		&client.CreatedAt,
 	)
 
@@ -147,7 +214,7 @@ func (db *DB) ListClients(ctx context.Context) ([]Client, error) {
 	var clients []Client
 
 	query := `
-        SELECT key, capacity, refill_rate, unlimited, created_at
+        SELECT key, capacity, refill_rate, unlimited, mode, max_body_bytes, max_header_count, max_header_bytes, created_at
         FROM clients
         ORDER BY created_at DESC
     `
@@ -166,6 +233,10 @@ func (db *DB) ListClients(ctx context.Context) ([]Client, error) {
 			&client.Capacity,
 			&client.RefillRate,
 			&client.Unlimited,
+			&client.Mode,
+			&client.MaxBodyBytes,
+			&client.MaxHeaderCount,
+			&client.MaxHeaderBytes,
 			&client.CreatedAt,
 		)
 		if err != nil {
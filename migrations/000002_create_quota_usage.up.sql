@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS quota_usage (
+    key TEXT NOT NULL,
+    instance TEXT NOT NULL,
+    demand BIGINT NOT NULL DEFAULT 0 CHECK (demand >= 0),
+    admitted BIGINT NOT NULL DEFAULT 0 CHECK (admitted >= 0),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (key, instance)
+);
+
+CREATE INDEX idx_quota_usage_updated_at ON quota_usage(updated_at);
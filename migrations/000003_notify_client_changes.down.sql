@@ -0,0 +1,2 @@
+DROP TRIGGER IF EXISTS clients_notify_change ON clients;
+DROP FUNCTION IF EXISTS notify_client_change();
\ No newline at end of file
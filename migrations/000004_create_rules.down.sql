@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS rules_notify_change ON rules;
+DROP FUNCTION IF EXISTS notify_rule_change();
+DROP TABLE IF EXISTS rules;
\ No newline at end of file
@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS rules (
+    id BIGINT PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY,
+    pattern TEXT UNIQUE NOT NULL,
+    capacity BIGINT NOT NULL CHECK (capacity >= 0),
+    refill_rate INTERVAL NOT NULL CHECK (refill_rate > INTERVAL '0 seconds'),
+    scope TEXT NOT NULL DEFAULT 'client' CHECK (scope IN ('client', 'global')),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE OR REPLACE FUNCTION notify_rule_change() RETURNS TRIGGER AS $$
+BEGIN
+    PERFORM pg_notify('rule_changes', json_build_object(
+        'op', TG_OP,
+        'id', COALESCE(NEW.id, OLD.id)
+    )::TEXT);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER rules_notify_change
+AFTER INSERT OR UPDATE OR DELETE ON rules
+FOR EACH ROW EXECUTE FUNCTION notify_rule_change();
@@ -0,0 +1,27 @@
+ALTER TABLE clients
+    ADD COLUMN IF NOT EXISTS mode TEXT NOT NULL DEFAULT 'enforce' CHECK (mode IN ('enforce', 'shadow', 'off'));
+
+ALTER TABLE rules
+    ADD COLUMN IF NOT EXISTS mode TEXT NOT NULL DEFAULT 'enforce' CHECK (mode IN ('enforce', 'shadow', 'off'));
+
+CREATE OR REPLACE FUNCTION notify_client_change() RETURNS TRIGGER AS $$
+DECLARE
+    payload JSON;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        payload := json_build_object('op', TG_OP, 'key', OLD.key);
+    ELSE
+        payload := json_build_object(
+            'op', TG_OP,
+            'key', NEW.key,
+            'capacity', NEW.capacity,
+            'refill_rate', (EXTRACT(EPOCH FROM NEW.refill_rate) * 1000000000)::BIGINT,
+            'unlimited', NEW.unlimited,
+            'mode', NEW.mode
+        );
+    END IF;
+
+    PERFORM pg_notify('client_changes', payload::TEXT);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS access_entries_notify_change ON access_entries;
+DROP FUNCTION IF EXISTS notify_access_entry_change();
+DROP TABLE IF EXISTS access_entries;
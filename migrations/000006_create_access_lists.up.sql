@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS access_entries (
+    id BIGINT PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY,
+    list TEXT NOT NULL CHECK (list IN ('allow', 'deny')),
+    cidr CIDR,
+    key_pattern TEXT,
+    comment TEXT NOT NULL DEFAULT '',
+    expires_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CHECK ((cidr IS NULL) <> (key_pattern IS NULL))
+);
+
+CREATE INDEX IF NOT EXISTS access_entries_list_idx ON access_entries (list);
+
+CREATE OR REPLACE FUNCTION notify_access_entry_change() RETURNS TRIGGER AS $$
+BEGIN
+    PERFORM pg_notify('access_list_changes', json_build_object(
+        'op', TG_OP,
+        'id', COALESCE(NEW.id, OLD.id)
+    )::TEXT);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER access_entries_notify_change
+AFTER INSERT OR UPDATE OR DELETE ON access_entries
+FOR EACH ROW EXECUTE FUNCTION notify_access_entry_change();
@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS bans_notify_change ON bans;
+DROP FUNCTION IF EXISTS notify_ban_change();
+DROP TABLE IF EXISTS bans;
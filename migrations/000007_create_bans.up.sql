@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS bans (
+    key TEXT PRIMARY KEY,
+    offenses INT NOT NULL DEFAULT 1,
+    reason TEXT NOT NULL DEFAULT '',
+    banned_until TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS bans_banned_until_idx ON bans (banned_until);
+
+CREATE OR REPLACE FUNCTION notify_ban_change() RETURNS TRIGGER AS $$
+BEGIN
+    PERFORM pg_notify('ban_changes', json_build_object(
+        'op', TG_OP,
+        'key', COALESCE(NEW.key, OLD.key)
+    )::TEXT);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER bans_notify_change
+AFTER INSERT OR UPDATE OR DELETE ON bans
+FOR EACH ROW EXECUTE FUNCTION notify_ban_change();
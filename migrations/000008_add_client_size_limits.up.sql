@@ -0,0 +1,29 @@
+ALTER TABLE clients
+    ADD COLUMN IF NOT EXISTS max_body_bytes BIGINT NOT NULL DEFAULT 0 CHECK (max_body_bytes >= 0),
+    ADD COLUMN IF NOT EXISTS max_header_count INT NOT NULL DEFAULT 0 CHECK (max_header_count >= 0),
+    ADD COLUMN IF NOT EXISTS max_header_bytes BIGINT NOT NULL DEFAULT 0 CHECK (max_header_bytes >= 0);
+
+CREATE OR REPLACE FUNCTION notify_client_change() RETURNS TRIGGER AS $$
+DECLARE
+    payload JSON;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        payload := json_build_object('op', TG_OP, 'key', OLD.key);
+    ELSE
+        payload := json_build_object(
+            'op', TG_OP,
+            'key', NEW.key,
+            'capacity', NEW.capacity,
+            'refill_rate', (EXTRACT(EPOCH FROM NEW.refill_rate) * 1000000000)::BIGINT,
+            'unlimited', NEW.unlimited,
+            'mode', NEW.mode,
+            'max_body_bytes', NEW.max_body_bytes,
+            'max_header_count', NEW.max_header_count,
+            'max_header_bytes', NEW.max_header_bytes
+        );
+    END IF;
+
+    PERFORM pg_notify('client_changes', payload::TEXT);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
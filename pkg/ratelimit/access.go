@@ -0,0 +1,21 @@
+package ratelimit
+
+import "net/netip"
+
+type Access int
+
+const (
+	// AccessDefault leaves the request to the limits.
+	AccessDefault Access = iota
+	AccessAllow
+	AccessDeny
+)
+
+const TypeDenied = "urn:ratelimit:problem:denied"
+
+// AccessList is consulted before any limit. Allowed clients are not limited
+// at all and denied ones are rejected with 403. key is empty for clients
+// that could not be identified.
+type AccessList interface {
+	Check(key string, addr netip.Addr) Access
+}
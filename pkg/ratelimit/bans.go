@@ -0,0 +1,35 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const TypeBanned = "urn:ratelimit:problem:banned"
+
+// Bans keeps out clients that keep sending requests over the limit. It is
+// told about every rejection and decides when a client is banned. Rejected
+// is called on the request path, so it should not block.
+type Bans interface {
+	BannedUntil(key string) (time.Time, bool)
+	Rejected(ctx context.Context, key string)
+}
+
+// BannedProblem describes the rejection of r because key is banned.
+func BannedProblem(r *http.Request, key string, until time.Time) Problem {
+	p := NewProblem(http.StatusForbidden, "Too many requests over the limit, banned until "+until.UTC().Format(time.RFC3339)+".")
+	p.Type = TypeBanned
+	p.Title = "Client Banned"
+	p.Instance = r.URL.Path
+	p.ClientKey = key
+	p.RetryAfter = max(1, ceilSeconds(time.Until(until)))
+	return p
+}
+
+func writeBanned(w http.ResponseWriter, r *http.Request, key string, until time.Time) {
+	p := BannedProblem(r, key, until)
+	w.Header().Set("Retry-After", strconv.FormatInt(p.RetryAfter, 10))
+	WriteProblem(w, p)
+}
@@ -0,0 +1,278 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+type TokenBucket struct {
+	capacity   int64
+	tokens     int64
+	refillRate time.Duration
+	lastRefill time.Time
+	unlimited  bool
+	mu         sync.Mutex
+
+	// baseCapacity and baseRefillRate hold the configured limit, while
+	// capacity and refillRate may be scaled down to a share of it.
+	baseCapacity   int64
+	baseRefillRate time.Duration
+	share          float64
+	demand         int64
+	admitted       int64
+}
+
+// NewTokenBucket returns a full bucket. A refill rate of zero or less adds a
+// token every second.
+func NewTokenBucket(limit Limit) *TokenBucket {
+	refillRate := limit.RefillRate
+	if refillRate <= 0 {
+		refillRate = time.Second
+	}
+
+	return &TokenBucket{
+		capacity:   limit.Capacity,
+		tokens:     limit.Capacity,
+		refillRate: refillRate,
+		lastRefill: time.Now(),
+		unlimited:  limit.Unlimited,
+
+		baseCapacity:   limit.Capacity,
+		baseRefillRate: refillRate,
+		share:          1,
+	}
+}
+
+func (tb *TokenBucket) Allow() bool {
+	return tb.Take().Allowed
+}
+
+func (tb *TokenBucket) Take() Result {
+	return tb.TakeN(1)
+}
+
+// TakeN takes cost tokens at once, or none if there are fewer left.
+func (tb *TokenBucket) TakeN(cost int64) Result {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	if tb.unlimited {
+		return Result{Allowed: true, Unlimited: true}
+	}
+
+	now := time.Now()
+	tb.refill(now)
+
+	tb.demand += cost
+	allowed := tb.tokens >= cost
+	if allowed {
+		tb.tokens -= cost
+		tb.admitted += cost
+	}
+
+	return tb.result(allowed, cost, now)
+}
+
+// Return gives back n tokens taken by TakeN for something that did not
+// happen after all, up to the capacity.
+func (tb *TokenBucket) Return(n int64) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	if tb.unlimited {
+		return
+	}
+	tb.tokens = min(tb.capacity, tb.tokens+n)
+	tb.admitted = max(0, tb.admitted-n)
+}
+
+func (tb *TokenBucket) result(allowed bool, cost int64, now time.Time) Result {
+	res := Result{
+		Allowed:   allowed,
+		Limit:     tb.capacity,
+		Remaining: tb.tokens,
+		Window:    time.Duration(tb.capacity) * tb.refillRate,
+	}
+
+	if tb.tokens < tb.capacity {
+		nextToken := tb.refillRate - now.Sub(tb.lastRefill)%tb.refillRate
+		res.ResetAfter = nextToken + time.Duration(tb.capacity-tb.tokens-1)*tb.refillRate
+		if !allowed {
+			res.RetryAfter = nextToken + time.Duration(max(0, cost-tb.tokens-1))*tb.refillRate
+		}
+	}
+
+	return res
+}
+
+// Limit returns the configured limit, regardless of the share.
+func (tb *TokenBucket) Limit() Limit {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	return Limit{Capacity: tb.baseCapacity, RefillRate: tb.baseRefillRate, Unlimited: tb.unlimited}
+}
+
+// SetShare scales the bucket down to the given fraction of its configured
+// limit, so that several replicas together admit roughly that limit.
+func (tb *TokenBucket) SetShare(share float64) {
+	if share <= 0 || share > 1 {
+		share = 1
+	}
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.share = share
+	tb.capacity = max(1, int64(math.Round(float64(tb.baseCapacity)*share)))
+	tb.refillRate = time.Duration(float64(tb.baseRefillRate) / share)
+	tb.tokens = min(tb.tokens, tb.capacity)
+}
+
+// TokenPolicy decides what happens to the tokens of a bucket whose limit
+// changes.
+type TokenPolicy string
+
+const (
+	// PreserveTokens keeps the tokens, up to the new capacity.
+	PreserveTokens TokenPolicy = "preserve"
+	// ScaleTokens keeps the bucket as full as it was, relative to its
+	// capacity.
+	ScaleTokens TokenPolicy = "scale"
+	// ResetTokens fills the bucket.
+	ResetTokens TokenPolicy = "reset"
+)
+
+// SetLimit changes the configured limit in place, keeping the share, and
+// sets the tokens by policy. Tokens due at the old rate are added first.
+func (tb *TokenBucket) SetLimit(limit Limit, policy TokenPolicy) BucketState {
+	refillRate := limit.RefillRate
+	if refillRate <= 0 {
+		refillRate = time.Second
+	}
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	now := time.Now()
+	tb.refill(now)
+	oldCapacity, oldTokens := tb.capacity, tb.tokens
+
+	tb.baseCapacity = limit.Capacity
+	tb.baseRefillRate = refillRate
+	tb.unlimited = limit.Unlimited
+	tb.capacity = limit.Capacity
+	tb.refillRate = refillRate
+	if tb.share < 1 {
+		tb.capacity = max(1, int64(math.Round(float64(limit.Capacity)*tb.share)))
+		tb.refillRate = time.Duration(float64(refillRate) / tb.share)
+	}
+
+	switch {
+	case policy == ResetTokens || tb.unlimited:
+		tb.tokens = tb.capacity
+		tb.lastRefill = now
+	case policy == ScaleTokens && oldCapacity > 0:
+		tb.tokens = int64(math.Round(float64(oldTokens) * float64(tb.capacity) / float64(oldCapacity)))
+	case policy == ScaleTokens:
+		tb.tokens = tb.capacity
+	default:
+		tb.tokens = min(oldTokens, tb.capacity)
+	}
+
+	return tb.state(now)
+}
+
+// SetRemaining lowers the tokens to remaining, e.g. when an upstream reports
+// fewer requests left than the bucket has. It never adds tokens.
+func (tb *TokenBucket) SetRemaining(remaining int64) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	now := time.Now()
+	tb.refill(now)
+	if remaining < tb.tokens {
+		tb.tokens = max(0, remaining)
+	}
+}
+
+// TakeUsage returns the tokens requested and the tokens granted since the
+// last call.
+func (tb *TokenBucket) TakeUsage() (demand, admitted int64) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	demand, admitted = tb.demand, tb.admitted
+	tb.demand, tb.admitted = 0, 0
+	return demand, admitted
+}
+
+// Refill adds the tokens due since the last refill. Buckets also refill when
+// tokens are taken, so this is only needed to keep State up to date.
+func (tb *TokenBucket) Refill() {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.refill(time.Now())
+}
+
+func (tb *TokenBucket) refill(now time.Time) {
+	newTokens := int64(now.Sub(tb.lastRefill) / tb.refillRate)
+	if newTokens > 0 {
+		tb.tokens = min(tb.capacity, tb.tokens+newTokens)
+		tb.lastRefill = now
+	}
+}
+
+type BucketState struct {
+	Tokens      int64
+	Capacity    int64
+	RefillRate  time.Duration
+	LastRefill  time.Time
+	NextTokenIn time.Duration
+	Share       float64
+	Unlimited   bool
+}
+
+func (tb *TokenBucket) State() BucketState {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	return tb.state(time.Now())
+}
+
+// Reset refills the bucket to its capacity, or empties it if drain is set.
+func (tb *TokenBucket) Reset(drain bool) BucketState {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	now := time.Now()
+	tb.tokens = tb.capacity
+	if drain {
+		tb.tokens = 0
+	}
+	tb.lastRefill = now
+
+	return tb.state(now)
+}
+
+func (tb *TokenBucket) state(now time.Time) BucketState {
+	state := BucketState{
+		Tokens:     tb.tokens,
+		Capacity:   tb.capacity,
+		RefillRate: tb.refillRate,
+		LastRefill: tb.lastRefill,
+		Share:      tb.share,
+		Unlimited:  tb.unlimited,
+	}
+	if tb.unlimited {
+		state.Tokens = tb.capacity
+		return state
+	}
+
+	elapsed := now.Sub(tb.lastRefill)
+	state.Tokens = min(tb.capacity, tb.tokens+int64(elapsed/tb.refillRate))
+	if state.Tokens < tb.capacity {
+		state.NextTokenIn = tb.refillRate - elapsed%tb.refillRate
+	}
+
+	return state
+}
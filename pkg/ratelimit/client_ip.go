@@ -0,0 +1,173 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// IPResolver finds the client address of a request. The Forwarded,
+// X-Forwarded-For and X-Real-IP headers are only honored if the request comes
+// from a trusted proxy, and the forwarding chain is only followed through
+// trusted proxies, so clients cannot spoof their address by sending these
+// headers themselves.
+type IPResolver struct {
+	trusted []netip.Prefix
+}
+
+func NewIPResolver(trustedProxies []string) (*IPResolver, error) {
+	res := &IPResolver{}
+	for _, s := range trustedProxies {
+		prefix, err := ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", s, err)
+		}
+		res.trusted = append(res.trusted, prefix)
+	}
+	return res, nil
+}
+
+// ClientIP returns the client address as a string, or an empty string if
+// the address of the peer cannot be parsed.
+func (res *IPResolver) ClientIP(r *http.Request) string {
+	addr, ok := res.ClientAddr(r)
+	if !ok {
+		return ""
+	}
+	return addr.String()
+}
+
+func (res *IPResolver) ClientAddr(r *http.Request) (netip.Addr, bool) {
+	peer, ok := ParseAddr(r.RemoteAddr)
+	if !ok {
+		return netip.Addr{}, false
+	}
+	if !res.isTrusted(peer) {
+		return peer, true
+	}
+
+	if hops, ok := forwardedFor(r.Header.Values("Forwarded")); ok {
+		return res.walk(peer, hops), true
+	}
+	if hops := headerList(r.Header.Values("X-Forwarded-For")); len(hops) > 0 {
+		return res.walk(peer, hops), true
+	}
+	if addr, ok := ParseAddr(r.Header.Get("X-Real-IP")); ok {
+		return addr, true
+	}
+
+	return peer, true
+}
+
+// walk goes through the hops from the closest one to the farthest and
+// returns the first untrusted address. A hop that cannot be parsed stops the
+// walk at the proxy that added it.
+func (res *IPResolver) walk(peer netip.Addr, hops []string) netip.Addr {
+	addr := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, ok := ParseAddr(hops[i])
+		if !ok {
+			return addr
+		}
+		addr = hop
+		if !res.isTrusted(addr) {
+			return addr
+		}
+	}
+	return addr
+}
+
+func (res *IPResolver) isTrusted(addr netip.Addr) bool {
+	if res == nil {
+		return false
+	}
+	for _, prefix := range res.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor collects the for= parameters of RFC 7239 Forwarded headers.
+// The second result is false if there is no Forwarded header at all.
+func forwardedFor(values []string) ([]string, bool) {
+	if len(values) == 0 {
+		return nil, false
+	}
+
+	var hops []string
+	for _, element := range headerList(values) {
+		hop := ""
+		for _, pair := range strings.Split(element, ";") {
+			name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(name, "for") {
+				hop = strings.Trim(value, `"`)
+			}
+		}
+		// elements without for= keep their place, so that the walk stops there
+		hops = append(hops, hop)
+	}
+	return hops, true
+}
+
+func headerList(values []string) []string {
+	var items []string
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			items = append(items, strings.TrimSpace(item))
+		}
+	}
+	return items
+}
+
+// ParseAddr accepts a bare IPv4 or IPv6 address, optionally with a port, an
+// IPv6 address in brackets and a zone. IPv4-mapped IPv6 addresses are
+// returned as IPv4.
+func ParseAddr(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return netip.Addr{}, false
+	}
+
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return normalizeAddr(addr), true
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	} else if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		s = s[1 : len(s)-1]
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return normalizeAddr(addr), true
+}
+
+func normalizeAddr(addr netip.Addr) netip.Addr {
+	return addr.Unmap().WithZone("")
+}
+
+// ParsePrefix accepts a CIDR or a single address, which becomes a prefix
+// of full length.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, ok := ParseAddr(s)
+	if !ok {
+		return netip.Prefix{}, fmt.Errorf("not an IP address or CIDR")
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
@@ -0,0 +1,282 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/netip"
+	"testing"
+)
+
+func TestParseAddr(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{in: "192.0.2.1", want: "192.0.2.1", ok: true},
+		{in: " 192.0.2.1 ", want: "192.0.2.1", ok: true},
+		{in: "192.0.2.1:8080", want: "192.0.2.1", ok: true},
+		{in: "2001:db8::1", want: "2001:db8::1", ok: true},
+		{in: "[2001:db8::1]", want: "2001:db8::1", ok: true},
+		{in: "[2001:db8::1]:443", want: "2001:db8::1", ok: true},
+		{in: "fe80::1%eth0", want: "fe80::1", ok: true},
+		{in: "[fe80::1%eth0]:443", want: "fe80::1", ok: true},
+		{in: "::ffff:192.0.2.1", want: "192.0.2.1", ok: true},
+		{in: "[::ffff:192.0.2.1]:80", want: "192.0.2.1", ok: true},
+		{in: ""},
+		{in: "unknown"},
+		{in: "_hidden"},
+		{in: "192.0.2"},
+		{in: "example.com:80"},
+		{in: "[2001:db8::1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			addr, ok := ParseAddr(tt.in)
+			if ok != tt.ok {
+				t.Fatalf("ParseAddr(%q) ok = %v, want %v", tt.in, ok, tt.ok)
+			}
+			if ok && addr.String() != tt.want {
+				t.Errorf("ParseAddr(%q) = %s, want %s", tt.in, addr, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePrefix(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "10.0.0.0/8", want: "10.0.0.0/8"},
+		{in: "10.1.2.3/8", want: "10.0.0.0/8"},
+		{in: "2001:db8::1/32", want: "2001:db8::/32"},
+		{in: "::ffff:10.0.0.0/104", want: "10.0.0.0/8"},
+		{in: "192.0.2.1", want: "192.0.2.1/32"},
+		{in: "[2001:db8::1]", want: "2001:db8::1/128"},
+		{in: "::ffff:192.0.2.1", want: "192.0.2.1/32"},
+		{in: "10.0.0.0/33", wantErr: true},
+		{in: "proxy", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			prefix, err := ParsePrefix(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePrefix(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			}
+			if err == nil && prefix.String() != tt.want {
+				t.Errorf("ParsePrefix(%q) = %s, want %s", tt.in, prefix, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	res, err := NewIPResolver([]string{"10.0.0.0/8", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     http.Header
+		want       string
+		ok         bool
+	}{
+		{
+			name:       "peer without headers",
+			remoteAddr: "203.0.113.7:52000",
+			want:       "203.0.113.7",
+			ok:         true,
+		},
+		{
+			name:       "untrusted peer cannot spoof X-Forwarded-For",
+			remoteAddr: "203.0.113.7:52000",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			want:       "203.0.113.7",
+			ok:         true,
+		},
+		{
+			name:       "untrusted peer cannot spoof X-Real-IP",
+			remoteAddr: "203.0.113.7:52000",
+			header:     http.Header{"X-Real-Ip": {"198.51.100.1"}},
+			want:       "203.0.113.7",
+			ok:         true,
+		},
+		{
+			name:       "trusted peer X-Forwarded-For",
+			remoteAddr: "10.0.0.1:52000",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			want:       "198.51.100.1",
+			ok:         true,
+		},
+		{
+			name:       "chain stops at the first untrusted hop",
+			remoteAddr: "10.0.0.1:52000",
+			header:     http.Header{"X-Forwarded-For": {"192.0.2.99, 198.51.100.1, 10.0.0.2"}},
+			want:       "198.51.100.1",
+			ok:         true,
+		},
+		{
+			name:       "chain of trusted hops only",
+			remoteAddr: "10.0.0.1:52000",
+			header:     http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}},
+			want:       "10.0.0.3",
+			ok:         true,
+		},
+		{
+			name:       "chain over several header lines",
+			remoteAddr: "10.0.0.1:52000",
+			header:     http.Header{"X-Forwarded-For": {"192.0.2.99", "198.51.100.1, 10.0.0.2"}},
+			want:       "198.51.100.1",
+			ok:         true,
+		},
+		{
+			name:       "unparsable hop stops at the proxy that added it",
+			remoteAddr: "10.0.0.1:52000",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.1, garbage, 10.0.0.2"}},
+			want:       "10.0.0.2",
+			ok:         true,
+		},
+		{
+			name:       "X-Forwarded-For with IPv6 and ports",
+			remoteAddr: "[fd00::1]:443",
+			header:     http.Header{"X-Forwarded-For": {"[2001:db8::7]:4711, [fd00::2]:80"}},
+			want:       "2001:db8::7",
+			ok:         true,
+		},
+		{
+			name:       "Forwarded",
+			remoteAddr: "10.0.0.1:52000",
+			header:     http.Header{"Forwarded": {`for=192.0.2.60;proto=http;by=203.0.113.43`}},
+			want:       "192.0.2.60",
+			ok:         true,
+		},
+		{
+			name:       "Forwarded with quoted IPv6 and port",
+			remoteAddr: "10.0.0.1:52000",
+			header:     http.Header{"Forwarded": {`for=192.0.2.60, For="[2001:db8:cafe::17]:4711"`}},
+			want:       "2001:db8:cafe::17",
+			ok:         true,
+		},
+		{
+			name:       "Forwarded walks trusted hops",
+			remoteAddr: "10.0.0.1:52000",
+			header:     http.Header{"Forwarded": {`for=198.51.100.1, for=10.0.0.2`, `for=10.0.0.3`}},
+			want:       "198.51.100.1",
+			ok:         true,
+		},
+		{
+			name:       "Forwarded element without for stops the walk",
+			remoteAddr: "10.0.0.1:52000",
+			header:     http.Header{"Forwarded": {`for=198.51.100.1, proto=https`}},
+			want:       "10.0.0.1",
+			ok:         true,
+		},
+		{
+			name:       "Forwarded obfuscated identifier stops the walk",
+			remoteAddr: "10.0.0.1:52000",
+			header:     http.Header{"Forwarded": {`for=unknown`}},
+			want:       "10.0.0.1",
+			ok:         true,
+		},
+		{
+			name:       "Forwarded wins over X-Forwarded-For",
+			remoteAddr: "10.0.0.1:52000",
+			header: http.Header{
+				"Forwarded":       {`for=192.0.2.60`},
+				"X-Forwarded-For": {"198.51.100.1"},
+			},
+			want: "192.0.2.60",
+			ok:   true,
+		},
+		{
+			name:       "X-Forwarded-For wins over X-Real-IP",
+			remoteAddr: "10.0.0.1:52000",
+			header: http.Header{
+				"X-Forwarded-For": {"198.51.100.1"},
+				"X-Real-Ip":       {"192.0.2.60"},
+			},
+			want: "198.51.100.1",
+			ok:   true,
+		},
+		{
+			name:       "trusted peer X-Real-IP",
+			remoteAddr: "10.0.0.1:52000",
+			header:     http.Header{"X-Real-Ip": {"2001:db8::7"}},
+			want:       "2001:db8::7",
+			ok:         true,
+		},
+		{
+			name:       "trusted peer with invalid X-Real-IP",
+			remoteAddr: "10.0.0.1:52000",
+			header:     http.Header{"X-Real-Ip": {"nonsense"}},
+			want:       "10.0.0.1",
+			ok:         true,
+		},
+		{
+			name:       "IPv4-mapped peer is trusted as IPv4",
+			remoteAddr: "[::ffff:10.0.0.1]:52000",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			want:       "198.51.100.1",
+			ok:         true,
+		},
+		{
+			name:       "IPv4-mapped hop is returned as IPv4",
+			remoteAddr: "10.0.0.1:52000",
+			header:     http.Header{"X-Forwarded-For": {"::ffff:198.51.100.1"}},
+			want:       "198.51.100.1",
+			ok:         true,
+		},
+		{
+			name:       "zone of the peer is dropped",
+			remoteAddr: "[fe80::1%eth0]:52000",
+			want:       "fe80::1",
+			ok:         true,
+		},
+		{
+			name:       "invalid peer",
+			remoteAddr: "pipe",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.header != nil {
+				r.Header = tt.header
+			}
+
+			addr, ok := res.ClientAddr(r)
+			if ok != tt.ok {
+				t.Fatalf("ClientAddr() ok = %v, want %v", ok, tt.ok)
+			}
+			if ok && addr != netip.MustParseAddr(tt.want) {
+				t.Errorf("ClientAddr() = %s, want %s", addr, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientAddrWithoutTrustedProxies(t *testing.T) {
+	for _, res := range []*IPResolver{nil, {}} {
+		r, _ := http.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "10.0.0.1:52000"
+		r.Header.Set("X-Forwarded-For", "198.51.100.1")
+		r.Header.Set("Forwarded", "for=198.51.100.1")
+
+		if got := res.ClientIP(r); got != "10.0.0.1" {
+			t.Errorf("ClientIP() = %q, want the peer", got)
+		}
+	}
+}
+
+func TestNewIPResolverRejectsInvalidProxies(t *testing.T) {
+	if _, err := NewIPResolver([]string{"10.0.0.0/8", "lb.internal"}); err == nil {
+		t.Error("NewIPResolver() accepted a host name")
+	}
+}
@@ -0,0 +1,217 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ConnKeyPrefix keeps the per-key buckets of connections apart from the
+// request buckets of the same client in a Store.
+const ConnKeyPrefix = "conn:"
+
+// ConnLimits limits the traffic of long-lived connections like WebSockets,
+// where a token is a byte or a message. PerConn applies to every connection
+// on its own and PerKey to all connections of a client together. A Limit
+// without capacity is not applied.
+type ConnLimits struct {
+	PerConn Limit
+	PerKey  Limit
+}
+
+func (l ConnLimits) enabled() bool {
+	return applies(l.PerConn) || applies(l.PerKey)
+}
+
+func applies(limit Limit) bool {
+	return limit.Capacity > 0 && !limit.Unlimited
+}
+
+// ConnLimiter takes the tokens of one connection, from its own bucket and
+// from the bucket its client shares with its other connections.
+type ConnLimiter struct {
+	ctx  context.Context
+	key  string
+	conn *TokenBucket
+	// the shared bucket is looked up in store on every take, so that the
+	// store may evict it while it is idle
+	store  Store
+	shared Limit
+	// chunk is the most tokens one take can ever get
+	chunk int64
+}
+
+// NewConnLimiter limits a connection of key. The shared bucket comes from
+// store, so that connections on other instances count as well if the store
+// is shared.
+func NewConnLimiter(ctx context.Context, store Store, key string, limits ConnLimits) *ConnLimiter {
+	l := &ConnLimiter{ctx: context.WithoutCancel(ctx), key: key, store: store}
+	if applies(limits.PerConn) {
+		l.conn = NewTokenBucket(limits.PerConn)
+		l.chunk = limits.PerConn.Capacity
+	}
+	if applies(limits.PerKey) {
+		l.shared = limits.PerKey
+		if l.chunk == 0 || limits.PerKey.Capacity < l.chunk {
+			l.chunk = limits.PerKey.Capacity
+		}
+	}
+	return l
+}
+
+// Take takes n tokens from both buckets, or from neither: tokens taken from
+// the connection bucket are given back if the shared one rejects.
+func (l *ConnLimiter) Take(n int64) Result {
+	res := Result{Allowed: true, Unlimited: true}
+	if l.conn != nil {
+		res = l.conn.TakeN(n)
+		if !res.Allowed {
+			return res
+		}
+	}
+	if applies(l.shared) {
+		shared := l.store.Bucket(l.ctx, ConnKeyPrefix+l.key, l.shared).TakeN(n)
+		if !shared.Allowed && l.conn != nil {
+			l.conn.Return(n)
+		}
+		res = MostRestrictive(res, shared)
+	}
+	return res
+}
+
+// Wait takes n tokens, waiting for them as long as needed. More tokens than
+// the buckets hold are taken in several goes.
+func (l *ConnLimiter) Wait(ctx context.Context, n int64) error {
+	for n > 0 {
+		cost := n
+		if l.chunk > 0 {
+			cost = min(n, l.chunk)
+		}
+
+		res := l.Take(cost)
+		if res.Allowed {
+			n -= cost
+			continue
+		}
+
+		timer := time.NewTimer(max(res.RetryAfter, time.Millisecond))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return nil
+}
+
+// LimitConn limits the bytes read from c. Reads wait for tokens instead of
+// failing, so a fast sender is slowed down by TCP backpressure. The wait
+// ends when the connection is closed or its read deadline passes.
+func LimitConn(c net.Conn, l *ConnLimiter) net.Conn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &limitedConn{Conn: c, limiter: l, ctx: ctx, cancel: cancel}
+}
+
+type limitedConn struct {
+	net.Conn
+	limiter *ConnLimiter
+	// ctx is cancelled on Close
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	if c.limiter.chunk > 0 && int64(len(p)) > c.limiter.chunk {
+		p = p[:c.limiter.chunk]
+	}
+
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		if werr := c.wait(int64(n)); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+// wait takes the tokens of n bytes read, it fails like a read would on a
+// closed connection or after the read deadline.
+func (c *limitedConn) wait(n int64) error {
+	c.mu.Lock()
+	deadline := c.readDeadline
+	c.mu.Unlock()
+
+	ctx := c.ctx
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	err := c.limiter.Wait(ctx, n)
+	switch {
+	case errors.Is(err, context.Canceled):
+		return net.ErrClosed
+	case errors.Is(err, context.DeadlineExceeded):
+		return os.ErrDeadlineExceeded
+	}
+	return err
+}
+
+func (c *limitedConn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
+
+func (c *limitedConn) SetDeadline(t time.Time) error {
+	c.setReadDeadline(t)
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *limitedConn) SetReadDeadline(t time.Time) error {
+	c.setReadDeadline(t)
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *limitedConn) setReadDeadline(t time.Time) {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+}
+
+// MessageReader is the read side of a WebSocket connection, as in
+// gorilla/websocket.
+type MessageReader interface {
+	ReadMessage() (messageType int, p []byte, err error)
+}
+
+// LimitMessages limits the messages read from r, a token is a message.
+// ReadMessage fails with a *LimitedError for messages over the limit, the
+// connection usually should be closed with a policy violation then.
+func LimitMessages(r MessageReader, l *ConnLimiter) MessageReader {
+	return &limitedReader{r: r, limiter: l}
+}
+
+type limitedReader struct {
+	r       MessageReader
+	limiter *ConnLimiter
+}
+
+func (r *limitedReader) ReadMessage() (int, []byte, error) {
+	messageType, p, err := r.r.ReadMessage()
+	if err != nil {
+		return messageType, p, err
+	}
+
+	if res := r.limiter.Take(1); !res.Allowed {
+		return messageType, nil, &LimitedError{Key: r.limiter.key, RetryAfter: res.RetryAfter}
+	}
+	return messageType, p, nil
+}
@@ -0,0 +1,73 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// newDepletedConn returns a connection limited to one byte an hour, which
+// has used up that byte while the next one waits to be read.
+func newDepletedConn(t *testing.T) net.Conn {
+	t.Helper()
+
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go client.Write([]byte("ab"))
+
+	limiter := NewConnLimiter(context.Background(), NewMemoryStore(), "client-1", ConnLimits{
+		PerConn: Limit{Capacity: 1, RefillRate: time.Hour},
+	})
+	conn := LimitConn(server, limiter)
+	t.Cleanup(func() { conn.Close() })
+
+	if n, err := conn.Read(make([]byte, 8)); n != 1 || err != nil {
+		t.Fatalf("Read() = %d, %v, want the byte within the limit", n, err)
+	}
+	return conn
+}
+
+func TestLimitConnCloseEndsWait(t *testing.T) {
+	conn := newDepletedConn(t)
+
+	time.AfterFunc(20*time.Millisecond, func() { conn.Close() })
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 8))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("Read() error = %v, want net.ErrClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read() still waits for tokens after Close")
+	}
+}
+
+func TestLimitConnReadDeadlineEndsWait(t *testing.T) {
+	conn := newDepletedConn(t)
+
+	if err := conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 8))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("Read() error = %v, want os.ErrDeadlineExceeded", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read() still waits for tokens after the read deadline")
+	}
+}
@@ -0,0 +1,228 @@
+package ratelimit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+const TypeQueryTooComplex = "urn:ratelimit:problem:query-too-complex"
+
+// maxGraphQLFields bounds the fields counted per query, so that fragments
+// spread over and over cannot make the analysis itself expensive.
+const maxGraphQLFields = 100_000
+
+// RequestAnalyzer prices requests before they are limited. Analyze returns
+// the tokens r takes, or an error to reject it with. Errors that are a
+// Problem are written as they are, others as a 400 problem.
+type RequestAnalyzer interface {
+	Analyze(r *http.Request) (int64, error)
+}
+
+// GraphQLOptions configure a GraphQLAnalyzer. Weights are keyed by field
+// name, or by the name of the parent field and the field, like
+// "user.friends", which wins over the field name alone. Root fields have
+// the operation type as parent, like "mutation.createUser". Fields without
+// a weight weigh DefaultWeight, 1 if it is zero.
+type GraphQLOptions struct {
+	Weights       map[string]int64
+	DefaultWeight int64
+	// MaxComplexity rejects more complex queries, zero allows any.
+	MaxComplexity int64
+	// MaxBodyBytes is the largest body read, 1 MiB if it is zero.
+	MaxBodyBytes int64
+}
+
+// GraphQLAnalyzer uses the complexity of GraphQL queries as their cost. The
+// complexity is the sum of the weights of all fields, each multiplied by
+// its depth, so that nested lists cost more than flat ones. Requests carry
+// the query in a JSON body, possibly a batch, in an application/graphql
+// body, or in the query parameter of a GET.
+type GraphQLAnalyzer struct {
+	opts GraphQLOptions
+}
+
+func NewGraphQLAnalyzer(opts GraphQLOptions) *GraphQLAnalyzer {
+	if opts.DefaultWeight <= 0 {
+		opts.DefaultWeight = 1
+	}
+	if opts.MaxBodyBytes <= 0 {
+		opts.MaxBodyBytes = 1 << 20
+	}
+	return &GraphQLAnalyzer{opts: opts}
+}
+
+type graphQLRequest struct {
+	Query         string `json:"query"`
+	OperationName string `json:"operationName"`
+}
+
+func (a *GraphQLAnalyzer) Analyze(r *http.Request) (int64, error) {
+	requests, err := a.read(r)
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, req := range requests {
+		complexity, err := a.Complexity(req.Query, req.OperationName)
+		if err != nil {
+			return 0, NewProblem(http.StatusBadRequest, err.Error())
+		}
+		total += complexity
+	}
+
+	if a.opts.MaxComplexity > 0 && total > a.opts.MaxComplexity {
+		p := NewProblem(http.StatusBadRequest, "Query complexity of "+strconv.FormatInt(total, 10)+" exceeds the maximum of "+strconv.FormatInt(a.opts.MaxComplexity, 10)+".")
+		p.Type = TypeQueryTooComplex
+		p.Title = "Query Too Complex"
+		p.Limit = a.opts.MaxComplexity
+		return 0, p
+	}
+	return max(1, total), nil
+}
+
+// Complexity returns the complexity of the operation named operationName in
+// query, which may be empty if there is only one.
+func (a *GraphQLAnalyzer) Complexity(query, operationName string) (int64, error) {
+	doc, err := parseGraphQL(query)
+	if err != nil {
+		return 0, err
+	}
+
+	var op *gqlOperation
+	for i := range doc.operations {
+		if operationName == "" || doc.operations[i].name == operationName {
+			if op != nil {
+				return 0, errors.New("operationName is required for documents with several operations")
+			}
+			op = &doc.operations[i]
+		}
+	}
+	if op == nil {
+		return 0, fmt.Errorf("unknown operation %q", operationName)
+	}
+
+	c := &complexity{analyzer: a, fragments: doc.fragments, visiting: make(map[string]bool)}
+	if err := c.add(op.kind, op.selections, 1); err != nil {
+		return 0, err
+	}
+	return c.total, nil
+}
+
+type complexity struct {
+	analyzer  *GraphQLAnalyzer
+	fragments map[string][]gqlSelection
+	visiting  map[string]bool
+	total     int64
+	fields    int
+}
+
+func (c *complexity) add(parent string, selections []gqlSelection, depth int64) error {
+	for _, sel := range selections {
+		switch {
+		case sel.spread != "":
+			fragment, ok := c.fragments[sel.spread]
+			if !ok {
+				return fmt.Errorf("unknown fragment %q", sel.spread)
+			}
+			if c.visiting[sel.spread] {
+				return fmt.Errorf("fragment %q spreads itself", sel.spread)
+			}
+			c.visiting[sel.spread] = true
+			err := c.add(parent, fragment, depth)
+			c.visiting[sel.spread] = false
+			if err != nil {
+				return err
+			}
+		case sel.name == "":
+			if err := c.add(parent, sel.selections, depth); err != nil {
+				return err
+			}
+		default:
+			if c.fields++; c.fields > maxGraphQLFields {
+				return errors.New("query has too many fields")
+			}
+			c.total += c.analyzer.weight(parent, sel.name) * depth
+			if err := c.add(sel.name, sel.selections, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (a *GraphQLAnalyzer) weight(parent, field string) int64 {
+	if w, ok := a.opts.Weights[parent+"."+field]; ok {
+		return w
+	}
+	if w, ok := a.opts.Weights[field]; ok {
+		return w
+	}
+	return a.opts.DefaultWeight
+}
+
+// read returns the queries of r and leaves the body for the handler.
+func (a *GraphQLAnalyzer) read(r *http.Request) ([]graphQLRequest, error) {
+	if r.Method == http.MethodGet {
+		q := r.URL.Query()
+		if !q.Has("query") {
+			return nil, nil
+		}
+		return []graphQLRequest{{Query: q.Get("query"), OperationName: q.Get("operationName")}}, nil
+	}
+	// preflights and other requests without a body carry no query
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 && !methodHasBody(r.Method) {
+		return nil, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, a.opts.MaxBodyBytes+1))
+	r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+	if err != nil {
+		if p, ok := BodyTooLargeProblem(r, err); ok {
+			return nil, p
+		}
+		return nil, err
+	}
+	if int64(len(body)) > a.opts.MaxBodyBytes {
+		return nil, NewProblem(http.StatusRequestEntityTooLarge, "The body is over "+strconv.FormatInt(a.opts.MaxBodyBytes, 10)+" bytes.")
+	}
+
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil, nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/graphql" {
+		return []graphQLRequest{{Query: string(body), OperationName: r.URL.Query().Get("operationName")}}, nil
+	}
+
+	if body[0] == '[' {
+		var batch []graphQLRequest
+		if err := json.Unmarshal(body, &batch); err != nil {
+			return nil, NewProblem(http.StatusBadRequest, "Invalid GraphQL request body.")
+		}
+		return batch, nil
+	}
+
+	var req graphQLRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, NewProblem(http.StatusBadRequest, "Invalid GraphQL request body.")
+	}
+	return []graphQLRequest{req}, nil
+}
+
+// methodHasBody reports whether requests with method usually carry a body.
+func methodHasBody(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,376 @@
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The GraphQL parser only reads what the complexity needs: operations,
+// fragments and their selection sets. Arguments, variables and directives
+// are skipped.
+
+type gqlDocument struct {
+	operations []gqlOperation
+	fragments  map[string][]gqlSelection
+}
+
+type gqlOperation struct {
+	kind       string
+	name       string
+	selections []gqlSelection
+}
+
+// gqlSelection is a field, an inline fragment with an empty name, or a
+// fragment spread naming its fragment in spread.
+type gqlSelection struct {
+	name       string
+	spread     string
+	selections []gqlSelection
+}
+
+type gqlToken struct {
+	kind  byte // 'n' name, 'v' value (number or string), or the punctuator
+	value string
+}
+
+type gqlParser struct {
+	src string
+	pos int
+	tok gqlToken
+	// nesting bounds the recursion on deeply nested selection sets
+	nesting int
+}
+
+const maxGraphQLNesting = 256
+
+var errGraphQLSyntax = errors.New("invalid GraphQL query")
+
+func parseGraphQL(src string) (doc gqlDocument, err error) {
+	p := &gqlParser{src: strings.TrimPrefix(src, "\ufeff")}
+	doc.fragments = make(map[string][]gqlSelection)
+	if err := p.advance(); err != nil {
+		return doc, err
+	}
+
+	for p.tok.kind != 0 {
+		switch {
+		case p.tok.kind == '{':
+			sel, err := p.selectionSet()
+			if err != nil {
+				return doc, err
+			}
+			doc.operations = append(doc.operations, gqlOperation{kind: "query", selections: sel})
+		case p.tok.kind == 'n' && (p.tok.value == "query" || p.tok.value == "mutation" || p.tok.value == "subscription"):
+			op, err := p.operation()
+			if err != nil {
+				return doc, err
+			}
+			doc.operations = append(doc.operations, op)
+		case p.tok.kind == 'n' && p.tok.value == "fragment":
+			name, sel, err := p.fragment()
+			if err != nil {
+				return doc, err
+			}
+			doc.fragments[name] = sel
+		default:
+			return doc, p.unexpected()
+		}
+	}
+
+	if len(doc.operations) == 0 {
+		return doc, fmt.Errorf("%w: no operation", errGraphQLSyntax)
+	}
+	return doc, nil
+}
+
+func (p *gqlParser) operation() (gqlOperation, error) {
+	op := gqlOperation{kind: p.tok.value}
+	if err := p.advance(); err != nil {
+		return op, err
+	}
+	if p.tok.kind == 'n' {
+		op.name = p.tok.value
+		if err := p.advance(); err != nil {
+			return op, err
+		}
+	}
+	if p.tok.kind == '(' {
+		if err := p.skipBalanced('(', ')'); err != nil {
+			return op, err
+		}
+	}
+	if err := p.directives(); err != nil {
+		return op, err
+	}
+
+	sel, err := p.selectionSet()
+	op.selections = sel
+	return op, err
+}
+
+func (p *gqlParser) fragment() (string, []gqlSelection, error) {
+	if err := p.advance(); err != nil {
+		return "", nil, err
+	}
+	name, err := p.name()
+	if err != nil {
+		return "", nil, err
+	}
+	if p.tok.kind != 'n' || p.tok.value != "on" {
+		return "", nil, p.unexpected()
+	}
+	if err := p.advance(); err != nil {
+		return "", nil, err
+	}
+	if _, err := p.name(); err != nil {
+		return "", nil, err
+	}
+	if err := p.directives(); err != nil {
+		return "", nil, err
+	}
+
+	sel, err := p.selectionSet()
+	return name, sel, err
+}
+
+func (p *gqlParser) selectionSet() ([]gqlSelection, error) {
+	if p.tok.kind != '{' {
+		return nil, p.unexpected()
+	}
+	if p.nesting++; p.nesting > maxGraphQLNesting {
+		return nil, fmt.Errorf("%w: nested too deeply", errGraphQLSyntax)
+	}
+	defer func() { p.nesting-- }()
+
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	var selections []gqlSelection
+	for p.tok.kind != '}' {
+		sel, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, sel)
+	}
+	if len(selections) == 0 {
+		return nil, fmt.Errorf("%w: empty selection set", errGraphQLSyntax)
+	}
+	return selections, p.advance()
+}
+
+func (p *gqlParser) selection() (gqlSelection, error) {
+	var sel gqlSelection
+
+	if p.tok.kind == '.' {
+		if err := p.advance(); err != nil {
+			return sel, err
+		}
+		if p.tok.kind == 'n' && p.tok.value != "on" {
+			sel.spread = p.tok.value
+			if err := p.advance(); err != nil {
+				return sel, err
+			}
+			return sel, p.directives()
+		}
+		if p.tok.kind == 'n' {
+			if err := p.advance(); err != nil {
+				return sel, err
+			}
+			if _, err := p.name(); err != nil {
+				return sel, err
+			}
+		}
+		if err := p.directives(); err != nil {
+			return sel, err
+		}
+		children, err := p.selectionSet()
+		sel.selections = children
+		return sel, err
+	}
+
+	name, err := p.name()
+	if err != nil {
+		return sel, err
+	}
+	// an alias comes first
+	if p.tok.kind == ':' {
+		if err := p.advance(); err != nil {
+			return sel, err
+		}
+		if name, err = p.name(); err != nil {
+			return sel, err
+		}
+	}
+	sel.name = name
+
+	if p.tok.kind == '(' {
+		if err := p.skipBalanced('(', ')'); err != nil {
+			return sel, err
+		}
+	}
+	if err := p.directives(); err != nil {
+		return sel, err
+	}
+	if p.tok.kind == '{' {
+		children, err := p.selectionSet()
+		if err != nil {
+			return sel, err
+		}
+		sel.selections = children
+	}
+	return sel, nil
+}
+
+func (p *gqlParser) directives() error {
+	for p.tok.kind == '@' {
+		if err := p.advance(); err != nil {
+			return err
+		}
+		if _, err := p.name(); err != nil {
+			return err
+		}
+		if p.tok.kind == '(' {
+			if err := p.skipBalanced('(', ')'); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *gqlParser) name() (string, error) {
+	if p.tok.kind != 'n' {
+		return "", p.unexpected()
+	}
+	name := p.tok.value
+	return name, p.advance()
+}
+
+// skipBalanced skips from the current open token past its matching close
+// token.
+func (p *gqlParser) skipBalanced(open, close byte) error {
+	depth := 0
+	for {
+		switch p.tok.kind {
+		case 0:
+			return p.unexpected()
+		case open:
+			depth++
+		case close:
+			depth--
+		}
+		if err := p.advance(); err != nil {
+			return err
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+func (p *gqlParser) unexpected() error {
+	if p.tok.kind == 0 {
+		return fmt.Errorf("%w: unexpected end", errGraphQLSyntax)
+	}
+	return fmt.Errorf("%w: unexpected %q at %d", errGraphQLSyntax, p.tok.value, p.pos)
+}
+
+// advance reads the next token. The spread punctuator ... is returned as a
+// single '.'.
+func (p *gqlParser) advance() error {
+skip:
+	for p.pos < len(p.src) {
+		switch c := p.src[p.pos]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			p.pos++
+		case c == '#':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' && p.src[p.pos] != '\r' {
+				p.pos++
+			}
+		default:
+			break skip
+		}
+	}
+	if p.pos >= len(p.src) {
+		p.tok = gqlToken{}
+		return nil
+	}
+
+	start := p.pos
+	c := p.src[p.pos]
+	switch {
+	case strings.IndexByte("!$&()=:@[]{}|", c) >= 0:
+		p.pos++
+		p.tok = gqlToken{kind: c, value: string(c)}
+	case c == '.':
+		if !strings.HasPrefix(p.src[p.pos:], "...") {
+			return fmt.Errorf("%w: unexpected '.' at %d", errGraphQLSyntax, p.pos)
+		}
+		p.pos += 3
+		p.tok = gqlToken{kind: '.', value: "..."}
+	case isNameStart(c):
+		for p.pos < len(p.src) && isNameChar(p.src[p.pos]) {
+			p.pos++
+		}
+		p.tok = gqlToken{kind: 'n', value: p.src[start:p.pos]}
+	case c == '-' || c >= '0' && c <= '9':
+		p.pos++
+		for p.pos < len(p.src) && (isNameChar(p.src[p.pos]) || p.src[p.pos] == '.' || p.src[p.pos] == '+' || p.src[p.pos] == '-') {
+			p.pos++
+		}
+		p.tok = gqlToken{kind: 'v', value: p.src[start:p.pos]}
+	case c == '"':
+		if err := p.skipString(); err != nil {
+			return err
+		}
+		p.tok = gqlToken{kind: 'v', value: p.src[start:p.pos]}
+	default:
+		return fmt.Errorf("%w: unexpected character %q at %d", errGraphQLSyntax, c, p.pos)
+	}
+	return nil
+}
+
+func (p *gqlParser) skipString() error {
+	if strings.HasPrefix(p.src[p.pos:], `"""`) {
+		p.pos += 3
+		for p.pos < len(p.src) {
+			switch {
+			case strings.HasPrefix(p.src[p.pos:], `\"""`):
+				p.pos += 4
+			case strings.HasPrefix(p.src[p.pos:], `"""`):
+				p.pos += 3
+				return nil
+			default:
+				p.pos++
+			}
+		}
+		return fmt.Errorf("%w: unterminated string", errGraphQLSyntax)
+	}
+
+	p.pos++
+	for p.pos < len(p.src) {
+		switch p.src[p.pos] {
+		case '\\':
+			p.pos += 2
+		case '"':
+			p.pos++
+			return nil
+		case '\n', '\r':
+			return fmt.Errorf("%w: unterminated string", errGraphQLSyntax)
+		default:
+			p.pos++
+		}
+	}
+	return fmt.Errorf("%w: unterminated string", errGraphQLSyntax)
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isNameChar(c byte) bool {
+	return isNameStart(c) || c >= '0' && c <= '9'
+}
@@ -0,0 +1,255 @@
+package ratelimit
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestGraphQLComplexity(t *testing.T) {
+	a := NewGraphQLAnalyzer(GraphQLOptions{
+		Weights: map[string]int64{
+			"friends":             5,
+			"user.friends":        10,
+			"mutation.createUser": 20,
+		},
+	})
+
+	tests := []struct {
+		name      string
+		query     string
+		operation string
+		want      int64
+	}{
+		{name: "shorthand", query: `{ a b }`, want: 2},
+		{name: "nested fields cost their depth", query: `{ a { b { c } } }`, want: 1 + 2 + 3},
+		{name: "field weight", query: `{ friends }`, want: 5},
+		{name: "parent weight wins", query: `{ user { friends } }`, want: 1 + 20},
+		{name: "root weight", query: `mutation { createUser { id } }`, want: 20 + 2},
+		{name: "alias counts the field", query: `{ pals: friends }`, want: 5},
+		{name: "arguments and directives are skipped", query: `query Q($n: Int = 3) @live { a(first: $n, s: "}{", o: {x: [1, 2]}) @include(if: true) { b } }`, want: 1 + 2},
+		{name: "fragment spread", query: `{ ...F } fragment F on Query { a { b } }`, want: 1 + 2},
+		{name: "fragment used twice", query: `{ x { ...F } y { ...F } } fragment F on T { a }`, want: 1 + 2 + 1 + 2},
+		{name: "inline fragment", query: `{ node { ... on User { name } ... { id } } }`, want: 1 + 2 + 2},
+		{name: "named operation", query: `query A { a } query B { b c }`, operation: "B", want: 2},
+		{name: "comments and commas", query: "# head\n{ a, # a\n b }", want: 2},
+		{name: "block string", query: `{ a(s: """x "quoted" \""" }""") }`, want: 1},
+		{name: "byte order mark", query: "\ufeff{ a }", want: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := a.Complexity(tt.query, tt.operation)
+			if err != nil {
+				t.Fatalf("Complexity() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Complexity() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGraphQLComplexityErrors(t *testing.T) {
+	a := NewGraphQLAnalyzer(GraphQLOptions{})
+
+	tests := []struct {
+		name      string
+		query     string
+		operation string
+		want      string
+	}{
+		{name: "empty", query: ``, want: "no operation"},
+		{name: "only fragments", query: `fragment F on T { a }`, want: "no operation"},
+		{name: "unclosed selection", query: `{ a { b }`, want: "unexpected end"},
+		{name: "empty selection", query: `{ }`, want: "empty selection set"},
+		{name: "stray token", query: `} { a }`, want: "unexpected"},
+		{name: "bad character", query: `{ a; }`, want: "unexpected character"},
+		{name: "two dots", query: `{ ..F }`, want: "unexpected '.'"},
+		{name: "unterminated string", query: `{ a(s: "x) }`, want: "unterminated string"},
+		{name: "unterminated block string", query: `{ a(s: """x) }`, want: "unterminated string"},
+		{name: "unbalanced arguments", query: `{ a(s: 1 }`, want: "unexpected end"},
+		{name: "fragment without type", query: `{ ...F } fragment F { a }`, want: "unexpected"},
+		{name: "unknown fragment", query: `{ ...F }`, want: `unknown fragment "F"`},
+		{name: "fragment spreads itself", query: `{ ...F } fragment F on T { a ...F }`, want: `fragment "F" spreads itself`},
+		{name: "fragment cycle", query: `{ ...A } fragment A on T { ...B } fragment B on T { a ...A }`, want: "spreads itself"},
+		{name: "several operations without a name", query: `query A { a } query B { b }`, want: "operationName is required"},
+		{name: "unknown operation", query: `query A { a }`, operation: "B", want: `unknown operation "B"`},
+		{name: "nested too deeply", query: strings.Repeat("{ a ", maxGraphQLNesting+1) + strings.Repeat("}", maxGraphQLNesting+1), want: "nested too deeply"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := a.Complexity(tt.query, tt.operation)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Complexity() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestGraphQLComplexityNestingLimit(t *testing.T) {
+	a := NewGraphQLAnalyzer(GraphQLOptions{})
+	query := strings.Repeat("{ a ", maxGraphQLNesting) + strings.Repeat("}", maxGraphQLNesting)
+
+	got, err := a.Complexity(query, "")
+	if err != nil {
+		t.Fatalf("Complexity() error = %v", err)
+	}
+	n := int64(maxGraphQLNesting)
+	if want := n * (n + 1) / 2; got != want {
+		t.Errorf("Complexity() = %d, want %d", got, want)
+	}
+}
+
+func TestGraphQLComplexityFieldLimit(t *testing.T) {
+	a := NewGraphQLAnalyzer(GraphQLOptions{})
+
+	// every fragment spreads the next one ten times, so the last is
+	// reached 10^6 times
+	var b strings.Builder
+	b.WriteString("{ ...F0 }")
+	for i := range 6 {
+		b.WriteString(" fragment F" + strconv.Itoa(i) + " on T {")
+		for range 10 {
+			b.WriteString(" ...F" + strconv.Itoa(i+1))
+		}
+		b.WriteString(" }")
+	}
+	b.WriteString(" fragment F6 on T { a }")
+
+	if _, err := a.Complexity(b.String(), ""); err == nil || !strings.Contains(err.Error(), "too many fields") {
+		t.Errorf("Complexity() error = %v, want too many fields", err)
+	}
+}
+
+func TestGraphQLAnalyze(t *testing.T) {
+	a := NewGraphQLAnalyzer(GraphQLOptions{MaxBodyBytes: 64})
+
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		contentType string
+		body        string
+		want        int64
+		status      int
+	}{
+		{name: "JSON", method: http.MethodPost, body: `{"query": "{ a { b } }"}`, want: 3},
+		{name: "operation name", method: http.MethodPost, body: `{"query": "query A { a } query B { b c }", "operationName": "B"}`, want: 2},
+		{name: "batch", method: http.MethodPost, body: `[{"query": "{ a }"}, {"query": "{ a b }"}]`, want: 3},
+		{name: "empty batch", method: http.MethodPost, body: `[]`, want: 1},
+		{name: "application/graphql", method: http.MethodPost, contentType: "application/graphql", target: "/?operationName=B", body: `query A { a } query B { b c }`, want: 2},
+		{name: "GET", method: http.MethodGet, target: "/?query=" + url.QueryEscape("{ a b c }"), want: 3},
+		{name: "GET without query", method: http.MethodGet, want: 1},
+		{name: "OPTIONS preflight", method: http.MethodOptions, want: 1},
+		{name: "empty POST", method: http.MethodPost, want: 1},
+		{name: "blank body", method: http.MethodPost, body: " \n", want: 1},
+		{name: "invalid JSON", method: http.MethodPost, body: `{"query":`, status: http.StatusBadRequest},
+		{name: "invalid batch", method: http.MethodPost, body: `[{"query": 1}]`, status: http.StatusBadRequest},
+		{name: "invalid query", method: http.MethodPost, body: `{"query": "{ a"}`, status: http.StatusBadRequest},
+		{name: "batch with an invalid query", method: http.MethodPost, body: `[{"query": "{ a }"}, {"query": "{"}]`, status: http.StatusBadRequest},
+		{name: "body too large", method: http.MethodPost, body: `{"query": "{ ` + strings.Repeat("a ", 40) + `}"}`, status: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := tt.target
+			if target == "" {
+				target = "/"
+			}
+			var body io.Reader
+			if tt.body != "" {
+				body = strings.NewReader(tt.body)
+			}
+			r := httptest.NewRequest(tt.method, target, body)
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+
+			got, err := a.Analyze(r)
+			if tt.status != 0 {
+				var p Problem
+				if !errors.As(err, &p) || p.Status != tt.status {
+					t.Fatalf("Analyze() error = %v, want a %d problem", err, tt.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Analyze() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Analyze() = %d, want %d", got, tt.want)
+			}
+
+			// the handler still reads the whole body
+			rest, _ := io.ReadAll(r.Body)
+			if string(rest) != tt.body {
+				t.Errorf("body left for the handler = %q, want %q", rest, tt.body)
+			}
+		})
+	}
+}
+
+func TestGraphQLAnalyzeMaxComplexity(t *testing.T) {
+	a := NewGraphQLAnalyzer(GraphQLOptions{MaxComplexity: 3})
+
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`[{"query": "{ a b }"}, {"query": "{ c d }"}]`))
+	_, err := a.Analyze(r)
+	var p Problem
+	if !errors.As(err, &p) {
+		t.Fatalf("Analyze() error = %v, want a problem", err)
+	}
+	if p.Type != TypeQueryTooComplex || p.Status != http.StatusBadRequest || p.Limit != 3 {
+		t.Errorf("Analyze() problem = %+v", p)
+	}
+}
+
+func FuzzParseGraphQL(f *testing.F) {
+	for _, seed := range []string{
+		`{ a { b } }`,
+		`query Q($n: Int = 3) @live { a(first: $n) @include(if: true) { b } }`,
+		`{ ...F } fragment F on T { a ...F }`,
+		`{ node { ... on User { name } ... { id } } }`,
+		`{ a(s: """x \""" y""", t: "\"") }`,
+		"# comment\n{ a, b }",
+		`{ a(o: {x: [1, -2.5e3]}) }`,
+		strings.Repeat("{ a ", 300),
+	} {
+		f.Add(seed)
+	}
+
+	a := NewGraphQLAnalyzer(GraphQLOptions{})
+	f.Fuzz(func(t *testing.T, query string) {
+		got, err := a.Complexity(query, "")
+		if err == nil && got < 1 {
+			t.Errorf("Complexity(%q) = %d without an error", query, got)
+		}
+	})
+}
+
+func FuzzGraphQLAnalyze(f *testing.F) {
+	for _, seed := range []string{
+		`{"query": "{ a }"}`,
+		`[{"query": "{ a }"}, {"query": "{ b }"}]`,
+		`[]`,
+		``,
+		`{"query": "{ ...F } fragment F on T { a }"}`,
+	} {
+		f.Add(seed)
+	}
+
+	a := NewGraphQLAnalyzer(GraphQLOptions{MaxBodyBytes: 4096})
+	f.Fuzz(func(t *testing.T, body string) {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		got, err := a.Analyze(r)
+		if err == nil && got < 1 {
+			t.Errorf("Analyze(%q) = %d without an error", body, got)
+		}
+	})
+}
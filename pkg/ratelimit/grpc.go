@@ -0,0 +1,126 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+type GRPCOptions struct {
+	// MetadataKeys identify the client of a call, the value of the first one
+	// present is the client key. Calls without any of them are limited by the
+	// peer address, or rejected with codes.Unauthenticated if
+	// RejectUnidentified is set. x-api-key is used if no keys are given.
+	MetadataKeys       []string
+	RejectUnidentified bool
+	LegacyHeaders      bool
+}
+
+// UnaryServerInterceptor takes a token for every call. A RequestLimiter sees
+// the call as a POST request to the full method name, e.g.
+// "POST /orders.Orders/Create".
+func UnaryServerInterceptor(limiter Limiter, opts GRPCOptions) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		res, err := decideGRPC(ctx, limiter, opts, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+
+		if md := rateLimitMetadata(res, opts.LegacyHeaders); md.Len() > 0 {
+			_ = grpc.SetHeader(ctx, md)
+		}
+		if !res.Allowed {
+			return nil, exhausted(res)
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor takes a token when a stream is opened. Messages on
+// an open stream are not limited.
+func StreamServerInterceptor(limiter Limiter, opts GRPCOptions) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		res, err := decideGRPC(ss.Context(), limiter, opts, info.FullMethod)
+		if err != nil {
+			return err
+		}
+
+		if md := rateLimitMetadata(res, opts.LegacyHeaders); md.Len() > 0 {
+			_ = ss.SetHeader(md)
+		}
+		if !res.Allowed {
+			return exhausted(res)
+		}
+
+		return handler(srv, ss)
+	}
+}
+
+func decideGRPC(ctx context.Context, limiter Limiter, opts GRPCOptions, fullMethod string) (Result, error) {
+	key, identified := metadataKey(ctx, opts.MetadataKeys)
+	var addr netip.Addr
+	if !identified {
+		if opts.RejectUnidentified {
+			return Result{}, status.Error(codes.Unauthenticated, "unable to identify client")
+		}
+		if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+			key = p.Addr.String()
+			if a, ok := ParseAddr(key); ok {
+				addr = a
+				key = addr.String()
+			}
+		}
+	}
+
+	if rl, ok := limiter.(RequestLimiter); ok {
+		r := &http.Request{Method: http.MethodPost, URL: &url.URL{Path: fullMethod}, Header: http.Header{}}
+		return rl.TakeRequest(r.WithContext(ctx), key, addr, 1), nil
+	}
+	return limiter.Take(ctx, key, 1), nil
+}
+
+func metadataKey(ctx context.Context, keys []string) (string, bool) {
+	if len(keys) == 0 {
+		keys = []string{"x-api-key"}
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, k := range keys {
+		if v := md.Get(k); len(v) > 0 && v[0] != "" {
+			return v[0], true
+		}
+	}
+	return "", false
+}
+
+// rateLimitMetadata carries the rate limit headers as response metadata.
+func rateLimitMetadata(res Result, legacy bool) metadata.MD {
+	h := http.Header{}
+	SetHeaders(h, res, legacy)
+
+	md := metadata.MD{}
+	for name, values := range h {
+		md.Set(strings.ToLower(name), values...)
+	}
+	return md
+}
+
+func exhausted(res Result) error {
+	st := status.New(codes.ResourceExhausted, "too many requests")
+	st, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(res.RetryAfter)})
+	if err != nil {
+		return status.Error(codes.ResourceExhausted, "too many requests")
+	}
+	return st.Err()
+}
@@ -0,0 +1,271 @@
+package ratelimit
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// testPeer is the address the server sees for every client.
+var testPeer = netip.MustParseAddr("192.0.2.7")
+
+// peerListener gives the connections of a bufconn.Listener the address of
+// testPeer, which the peer of a call is taken from.
+type peerListener struct {
+	*bufconn.Listener
+}
+
+func (l peerListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return peerConn{conn}, nil
+}
+
+type peerConn struct {
+	net.Conn
+}
+
+func (peerConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: testPeer.AsSlice(), Port: 4711}
+}
+
+// recordingLimiter is a RequestLimiter that remembers the calls it limited
+// and answers them with a Limiter.
+type recordingLimiter struct {
+	Limiter
+
+	mu    sync.Mutex
+	calls []limitedCall
+}
+
+type limitedCall struct {
+	request string
+	key     string
+	addr    netip.Addr
+	cost    int64
+}
+
+func (l *recordingLimiter) TakeRequest(r *http.Request, key string, addr netip.Addr, cost int64) Result {
+	l.mu.Lock()
+	l.calls = append(l.calls, limitedCall{request: r.Method + " " + r.URL.Path, key: key, addr: addr, cost: cost})
+	l.mu.Unlock()
+	return l.Take(r.Context(), key, cost)
+}
+
+func (l *recordingLimiter) recorded() []limitedCall {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]limitedCall(nil), l.calls...)
+}
+
+// newTestHealthClient serves the health service behind both interceptors
+// over an in-process connection.
+func newTestHealthClient(t *testing.T, limiter Limiter, opts GRPCOptions) healthpb.HealthClient {
+	t.Helper()
+
+	lis := bufconn.Listen(1 << 20)
+	g := grpc.NewServer(
+		grpc.UnaryInterceptor(UnaryServerInterceptor(limiter, opts)),
+		grpc.StreamInterceptor(StreamServerInterceptor(limiter, opts)),
+	)
+	healthpb.RegisterHealthServer(g, health.NewServer())
+	go g.Serve(peerListener{lis})
+	t.Cleanup(g.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return healthpb.NewHealthClient(conn)
+}
+
+func newTestLimiter(capacity int64) *recordingLimiter {
+	return &recordingLimiter{Limiter: NewLimiter(NewMemoryStore(), Limit{Capacity: capacity, RefillRate: time.Minute})}
+}
+
+func TestGRPCClientKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		keys     []string
+		md       metadata.MD
+		wantKey  string
+		wantAddr netip.Addr
+	}{
+		{
+			name:    "x-api-key",
+			md:      metadata.Pairs("x-api-key", "client-1"),
+			wantKey: "client-1",
+		},
+		{
+			name:    "first metadata key present",
+			keys:    []string{"x-tenant", "x-api-key"},
+			md:      metadata.Pairs("x-api-key", "client-1", "x-tenant", "tenant-1"),
+			wantKey: "tenant-1",
+		},
+		{
+			name:    "later metadata key",
+			keys:    []string{"x-tenant", "x-api-key"},
+			md:      metadata.Pairs("x-api-key", "client-1"),
+			wantKey: "client-1",
+		},
+		{
+			name:     "metadata keys replace x-api-key",
+			keys:     []string{"x-tenant"},
+			md:       metadata.Pairs("x-api-key", "client-1"),
+			wantKey:  testPeer.String(),
+			wantAddr: testPeer,
+		},
+		{
+			name:     "empty key falls back to the peer",
+			md:       metadata.Pairs("x-api-key", ""),
+			wantKey:  testPeer.String(),
+			wantAddr: testPeer,
+		},
+		{
+			name:     "peer address",
+			wantKey:  testPeer.String(),
+			wantAddr: testPeer,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := newTestLimiter(10)
+			client := newTestHealthClient(t, limiter, GRPCOptions{MetadataKeys: tt.keys})
+
+			ctx := metadata.NewOutgoingContext(context.Background(), tt.md)
+			if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+				t.Fatalf("Check() error = %v", err)
+			}
+
+			calls := limiter.recorded()
+			if len(calls) != 1 {
+				t.Fatalf("limited %d calls, want 1", len(calls))
+			}
+			want := limitedCall{request: "POST /grpc.health.v1.Health/Check", key: tt.wantKey, addr: tt.wantAddr, cost: 1}
+			if calls[0] != want {
+				t.Errorf("limited %+v, want %+v", calls[0], want)
+			}
+		})
+	}
+}
+
+func TestGRPCRejectUnidentified(t *testing.T) {
+	limiter := newTestLimiter(10)
+	client := newTestHealthClient(t, limiter, GRPCOptions{RejectUnidentified: true})
+
+	_, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("Check() error = %v, want Unauthenticated", err)
+	}
+	if calls := limiter.recorded(); len(calls) != 0 {
+		t.Errorf("limited %d calls, want none", len(calls))
+	}
+}
+
+func TestGRPCUnaryRejected(t *testing.T) {
+	// a plain Limiter, which is not told the method
+	limiter := NewLimiter(NewMemoryStore(), Limit{Capacity: 1, RefillRate: time.Minute})
+	client := newTestHealthClient(t, limiter, GRPCOptions{LegacyHeaders: true})
+	ctx := metadata.NewOutgoingContext(context.Background(), metadata.Pairs("x-api-key", "client-1"))
+
+	var header metadata.MD
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{}, grpc.Header(&header)); err != nil {
+		t.Fatalf("Check() error = %v", err)
+	}
+	for name, want := range map[string]string{
+		"ratelimit-limit":     "1",
+		"ratelimit-remaining": "0",
+		"ratelimit-policy":    "1;w=60",
+		"x-ratelimit-limit":   "1",
+	} {
+		if got := header.Get(name); len(got) != 1 || got[0] != want {
+			t.Errorf("header %s = %v, want %s", name, got, want)
+		}
+	}
+
+	header = nil
+	_, err := client.Check(ctx, &healthpb.HealthCheckRequest{}, grpc.Header(&header))
+	st := status.Convert(err)
+	if st.Code() != codes.ResourceExhausted {
+		t.Fatalf("Check() error = %v, want ResourceExhausted", err)
+	}
+	var retry *errdetails.RetryInfo
+	for _, d := range st.Details() {
+		if r, ok := d.(*errdetails.RetryInfo); ok {
+			retry = r
+		}
+	}
+	if retry == nil {
+		t.Fatalf("details = %v, want a RetryInfo", st.Details())
+	}
+	if delay := retry.GetRetryDelay().AsDuration(); delay <= 0 || delay > time.Minute {
+		t.Errorf("retry delay = %s, want up to a minute", delay)
+	}
+	if got := header.Get("retry-after"); len(got) != 1 || got[0] == "0" {
+		t.Errorf("header retry-after = %v, want the delay", got)
+	}
+	if got := header.Get("ratelimit-remaining"); len(got) != 1 || got[0] != "0" {
+		t.Errorf("header ratelimit-remaining = %v, want 0", got)
+	}
+}
+
+func TestGRPCStream(t *testing.T) {
+	limiter := newTestLimiter(1)
+	client := newTestHealthClient(t, limiter, GRPCOptions{})
+	ctx, cancel := context.WithCancel(metadata.NewOutgoingContext(context.Background(), metadata.Pairs("x-api-key", "client-1")))
+	defer cancel()
+
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Watch() error = %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("Recv() error = %v", err)
+	}
+	header, err := stream.Header()
+	if err != nil {
+		t.Fatalf("Header() error = %v", err)
+	}
+	if got := header.Get("ratelimit-remaining"); len(got) != 1 || got[0] != "0" {
+		t.Errorf("header ratelimit-remaining = %v, want 0", got)
+	}
+
+	calls := limiter.recorded()
+	want := limitedCall{request: "POST /grpc.health.v1.Health/Watch", key: "client-1", cost: 1}
+	if len(calls) != 1 || calls[0] != want {
+		t.Fatalf("limited %+v, want a single %+v", calls, want)
+	}
+
+	// the open stream is not limited any more, a new one is
+	second, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Watch() error = %v", err)
+	}
+	if _, err := second.Recv(); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Recv() error = %v, want ResourceExhausted", err)
+	}
+}
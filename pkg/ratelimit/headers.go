@@ -0,0 +1,49 @@
+package ratelimit
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// SetHeaders writes the RateLimit-* headers from the IETF httpapi
+// draft and, if legacy is set, the widespread X-RateLimit-* ones, where the
+// reset is a unix timestamp instead of a number of seconds.
+//
+// Limits in shadow mode are not announced to the client, only the
+// X-RateLimit-Shadow header tells whether they would have rejected.
+func SetHeaders(h http.Header, res Result, legacy bool) {
+	if res.Shadow {
+		if res.WouldReject {
+			h.Set("X-RateLimit-Shadow", "reject")
+		} else {
+			h.Set("X-RateLimit-Shadow", "allow")
+		}
+		return
+	}
+	if res.Unlimited {
+		return
+	}
+
+	limit := strconv.FormatInt(res.Limit, 10)
+	remaining := strconv.FormatInt(res.Remaining, 10)
+
+	h.Set("RateLimit-Limit", limit)
+	h.Set("RateLimit-Remaining", remaining)
+	h.Set("RateLimit-Reset", strconv.FormatInt(ceilSeconds(res.ResetAfter), 10))
+	h.Set("RateLimit-Policy", limit+";w="+strconv.FormatInt(ceilSeconds(res.Window), 10))
+
+	if legacy {
+		h.Set("X-RateLimit-Limit", limit)
+		h.Set("X-RateLimit-Remaining", remaining)
+		h.Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(res.ResetAfter).Unix(), 10))
+	}
+
+	if !res.Allowed {
+		h.Set("Retry-After", strconv.FormatInt(max(1, ceilSeconds(res.RetryAfter)), 10))
+	}
+}
+
+func ceilSeconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
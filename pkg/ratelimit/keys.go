@@ -0,0 +1,156 @@
+package ratelimit
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type KeyExtractor interface {
+	Extract(r *http.Request) (string, bool)
+}
+
+type KeyExtractorFunc func(r *http.Request) (string, bool)
+
+func (f KeyExtractorFunc) Extract(r *http.Request) (string, bool) {
+	return f(r)
+}
+
+// KeyChain returns the key of the first extractor that matches the request.
+type KeyChain []KeyExtractor
+
+func (c KeyChain) Extract(r *http.Request) (string, bool) {
+	for _, e := range c {
+		if key, ok := e.Extract(r); ok {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+var DefaultKeyChain = KeyChain{HeaderKey("X-API-Key")}
+
+func HeaderKey(name string) KeyExtractor {
+	return KeyExtractorFunc(func(r *http.Request) (string, bool) {
+		v := r.Header.Get(name)
+		return v, v != ""
+	})
+}
+
+func QueryKey(name string) KeyExtractor {
+	return KeyExtractorFunc(func(r *http.Request) (string, bool) {
+		v := r.URL.Query().Get(name)
+		return v, v != ""
+	})
+}
+
+func CookieKey(name string) KeyExtractor {
+	return KeyExtractorFunc(func(r *http.Request) (string, bool) {
+		c, err := r.Cookie(name)
+		if err != nil || c.Value == "" {
+			return "", false
+		}
+		return c.Value, true
+	})
+}
+
+// BasicAuthKey uses the Basic auth username. The password is not checked.
+func BasicAuthKey() KeyExtractor {
+	return KeyExtractorFunc(func(r *http.Request) (string, bool) {
+		user, _, ok := r.BasicAuth()
+		return user, ok && user != ""
+	})
+}
+
+// PathSegmentKey uses the segment with the given zero-based index, so that
+// index 1 of /tenants/acme/items is "acme".
+func PathSegmentKey(index int) KeyExtractor {
+	return KeyExtractorFunc(func(r *http.Request) (string, bool) {
+		segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if index >= len(segments) || segments[index] == "" {
+			return "", false
+		}
+		return segments[index], true
+	})
+}
+
+// JWTClaimKey uses a claim of the bearer token in the given header. The token
+// signature is not verified, so the claim only identifies the client and must
+// not be trusted for anything else.
+func JWTClaimKey(header, claim string) KeyExtractor {
+	if header == "" {
+		header = "Authorization"
+	}
+	return KeyExtractorFunc(func(r *http.Request) (string, bool) {
+		token, ok := strings.CutPrefix(r.Header.Get(header), "Bearer ")
+		if !ok {
+			return "", false
+		}
+
+		parts := strings.Split(token, ".")
+		if len(parts) != 3 {
+			return "", false
+		}
+
+		payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil {
+			return "", false
+		}
+
+		var claims map[string]any
+		if err := json.Unmarshal(payload, &claims); err != nil {
+			return "", false
+		}
+
+		switch v := claims[claim].(type) {
+		case string:
+			return v, v != ""
+		case float64, bool:
+			return fmt.Sprint(v), true
+		}
+		return "", false
+	})
+}
+
+func IPKey(ips *IPResolver) KeyExtractor {
+	return KeyExtractorFunc(func(r *http.Request) (string, bool) {
+		ip := ips.ClientIP(r)
+		return ip, ip != ""
+	})
+}
+
+func RouteKey() KeyExtractor {
+	return KeyExtractorFunc(func(r *http.Request) (string, bool) {
+		return r.URL.Path, true
+	})
+}
+
+// CompositeKey joins the keys of all parts and matches only if all parts do,
+// e.g. a tenant header and the route give "acme:/items".
+func CompositeKey(sep string, parts ...KeyExtractor) KeyExtractor {
+	return KeyExtractorFunc(func(r *http.Request) (string, bool) {
+		keys := make([]string, 0, len(parts))
+		for _, p := range parts {
+			key, ok := p.Extract(r)
+			if !ok {
+				return "", false
+			}
+			keys = append(keys, key)
+		}
+		return strings.Join(keys, sep), true
+	})
+}
+
+// PrefixedKey puts prefix in front of the keys of e, e.g. to keep keys from
+// different sources apart.
+func PrefixedKey(prefix string, e KeyExtractor) KeyExtractor {
+	return KeyExtractorFunc(func(r *http.Request) (string, bool) {
+		key, ok := e.Extract(r)
+		if !ok {
+			return "", false
+		}
+		return prefix + key, true
+	})
+}
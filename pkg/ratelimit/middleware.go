@@ -0,0 +1,341 @@
+package ratelimit
+
+import (
+	"errors"
+	"net/http"
+	"net/netip"
+	"time"
+)
+
+// RequestLimiter is a Limiter that can pick the bucket by the request as
+// well, e.g. to apply per-route limits. addr is the client address if the
+// client is only known by it, and the zero Addr otherwise.
+type RequestLimiter interface {
+	Limiter
+	TakeRequest(r *http.Request, key string, addr netip.Addr, cost int64) Result
+}
+
+type Middleware struct {
+	limiter            Limiter
+	keys               KeyExtractor
+	ips                *IPResolver
+	rejectUnidentified bool
+	legacyHeaders      bool
+	cost               func(r *http.Request) int64
+	onReject           func(w http.ResponseWriter, r *http.Request, key string, res Result)
+	onUnidentified     http.Handler
+	onShadowReject     func(r *http.Request, key string, res Result)
+	access             AccessList
+	onDeny             func(w http.ResponseWriter, r *http.Request, key string)
+	bans               Bans
+	onBanned           func(w http.ResponseWriter, r *http.Request, key string, until time.Time)
+	maxConns           int64
+	conns              *connCounter
+	connStore          Store
+	connLimits         ConnLimits
+	queue              *FairQueue
+	analyzer           RequestAnalyzer
+	sizes              SizeGuard
+}
+
+type Option func(*Middleware)
+
+// WithKeys identifies the client by the first extractor that matches. The
+// X-API-Key header is used by default.
+func WithKeys(keys ...KeyExtractor) Option {
+	return func(m *Middleware) {
+		m.keys = KeyChain(keys)
+	}
+}
+
+// WithIPResolver sets how the address of clients without a key is found.
+// Without it, the address of the peer is used.
+func WithIPResolver(ips *IPResolver) Option {
+	return func(m *Middleware) {
+		m.ips = ips
+	}
+}
+
+// WithRejectUnidentified rejects requests without a key with 401 instead
+// of limiting them by the client address.
+func WithRejectUnidentified() Option {
+	return func(m *Middleware) {
+		m.rejectUnidentified = true
+	}
+}
+
+// WithLegacyHeaders adds the X-RateLimit-* headers, see SetHeaders.
+func WithLegacyHeaders() Option {
+	return func(m *Middleware) {
+		m.legacyHeaders = true
+	}
+}
+
+// WithCost sets the number of tokens a request takes, 1 by default.
+func WithCost(cost func(r *http.Request) int64) Option {
+	return func(m *Middleware) {
+		m.cost = cost
+	}
+}
+
+// WithAnalyzer prices requests with analyzer instead of the cost function,
+// and rejects the requests it fails on before any tokens are taken.
+func WithAnalyzer(analyzer RequestAnalyzer) Option {
+	return func(m *Middleware) {
+		m.analyzer = analyzer
+	}
+}
+
+// WithSizeGuard rejects requests over the size limits picked by guard,
+// with 431 for headers and 413 for bodies. Bodies without a length are
+// checked while they are read, the read fails with an
+// *http.MaxBytesError then.
+func WithSizeGuard(guard SizeGuard) Option {
+	return func(m *Middleware) {
+		m.sizes = guard
+	}
+}
+
+// WithRejectHandler writes the response to rejected requests, after the
+// rate limit headers have been set. By default it is a 429 with a
+// RateLimitedProblem.
+func WithRejectHandler(h func(w http.ResponseWriter, r *http.Request, key string, res Result)) Option {
+	return func(m *Middleware) {
+		m.onReject = h
+	}
+}
+
+// WithUnidentifiedHandler writes the response to requests rejected by
+// WithRejectUnidentified. By default it is a 401 problem.
+func WithUnidentifiedHandler(h http.Handler) Option {
+	return func(m *Middleware) {
+		m.onUnidentified = h
+	}
+}
+
+// WithShadowRejectHook is called for requests that a limit in shadow mode
+// would have rejected, e.g. to log and count them. The request goes on.
+func WithShadowRejectHook(hook func(r *http.Request, key string, res Result)) Option {
+	return func(m *Middleware) {
+		m.onShadowReject = hook
+	}
+}
+
+// WithAccessList lets the allowed clients of list through without bans and
+// rate limits and rejects the denied ones. The size guard and the analyzer
+// still check the requests of allowed clients.
+func WithAccessList(list AccessList) Option {
+	return func(m *Middleware) {
+		m.access = list
+	}
+}
+
+// WithDenyHandler writes the response to denied requests. By default it is
+// a 403 problem.
+func WithDenyHandler(h func(w http.ResponseWriter, r *http.Request, key string)) Option {
+	return func(m *Middleware) {
+		m.onDeny = h
+	}
+}
+
+// WithBans rejects banned clients before any limit is checked and reports
+// the rejections by a limit to bans.
+func WithBans(bans Bans) Option {
+	return func(m *Middleware) {
+		m.bans = bans
+	}
+}
+
+// WithBannedHandler writes the response to requests of banned clients. By
+// default it is a 403 problem with a Retry-After header.
+func WithBannedHandler(h func(w http.ResponseWriter, r *http.Request, key string, until time.Time)) Option {
+	return func(m *Middleware) {
+		m.onBanned = h
+	}
+}
+
+// WithMaxConnections limits the upgraded connections, like WebSockets, a
+// client may hold at once. A connection counts until the handler returns.
+func WithMaxConnections(n int64) Option {
+	return func(m *Middleware) {
+		m.maxConns = n
+	}
+}
+
+// WithConnLimits limits the bytes clients send over upgraded connections.
+// The per-key buckets are kept in store.
+func WithConnLimits(store Store, limits ConnLimits) Option {
+	return func(m *Middleware) {
+		m.connStore = store
+		m.connLimits = limits
+	}
+}
+
+// WithFairQueue makes requests within the limits wait for their turn in
+// queue before they are served. Upgraded connections skip the queue.
+func WithFairQueue(queue *FairQueue) Option {
+	return func(m *Middleware) {
+		m.queue = queue
+	}
+}
+
+func NewMiddleware(limiter Limiter, opts ...Option) *Middleware {
+	m := &Middleware{
+		limiter: limiter,
+		keys:    DefaultKeyChain,
+		cost: func(*http.Request) int64 {
+			return 1
+		},
+		onReject: func(w http.ResponseWriter, r *http.Request, key string, res Result) {
+			WriteProblem(w, RateLimitedProblem(r, key, res))
+		},
+		onUnidentified: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p := NewProblem(http.StatusUnauthorized, "Unable to identify client.")
+			p.Type = TypeUnidentified
+			p.Instance = r.URL.Path
+			WriteProblem(w, p)
+		}),
+		onDeny: func(w http.ResponseWriter, r *http.Request, key string) {
+			p := NewProblem(http.StatusForbidden, "Access denied.")
+			p.Type = TypeDenied
+			p.Instance = r.URL.Path
+			p.ClientKey = key
+			WriteProblem(w, p)
+		},
+		onBanned: writeBanned,
+		conns:    newConnCounter(),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+func (m *Middleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res, key, ok := m.Take(w, r)
+		if !ok {
+			return
+		}
+
+		m.SetHeaders(w.Header(), res)
+		if !res.Allowed {
+			m.onReject(w, r, key, res)
+			return
+		}
+
+		if isUpgrade(r) {
+			if m.maxConns > 0 {
+				if !m.conns.acquire(key, m.maxConns) {
+					writeTooManyConnections(w, r, key, m.maxConns)
+					return
+				}
+				defer m.conns.release(key)
+			}
+			if m.connStore != nil && m.connLimits.enabled() {
+				w = &limitedHijacker{ResponseWriter: w, limiter: NewConnLimiter(r.Context(), m.connStore, key, m.connLimits)}
+			}
+		} else if m.queue != nil {
+			release, err := m.queue.Acquire(r.Context(), key)
+			if err != nil {
+				if r.Context().Err() == nil {
+					writeQueueError(w, r, key, err, m.queue.opts.MaxWait)
+				}
+				return
+			}
+			defer release()
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Take takes tokens for r from the bucket it counts against and returns
+// the client key as well. It reports false if the request was rejected
+// before that, the response has been written then.
+func (m *Middleware) Take(w http.ResponseWriter, r *http.Request) (Result, string, bool) {
+	key, identified := m.keys.Extract(r)
+
+	// allowed clients skip the bans and limits, but not the size limits and
+	// the analyzer
+	allowed := false
+	if m.access != nil {
+		listKey := key
+		if !identified {
+			listKey = ""
+		}
+		clientAddr, _ := m.ips.ClientAddr(r)
+		switch m.access.Check(listKey, clientAddr) {
+		case AccessDeny:
+			m.onDeny(w, r, key)
+			return Result{}, key, false
+		case AccessAllow:
+			allowed = true
+		}
+	}
+
+	var addr netip.Addr
+	if !identified {
+		if m.rejectUnidentified && !allowed {
+			m.onUnidentified.ServeHTTP(w, r)
+			return Result{}, "", false
+		}
+		key = r.RemoteAddr
+		if a, ok := m.ips.ClientAddr(r); ok {
+			addr = a
+			key = addr.String()
+		}
+	}
+
+	if m.bans != nil && !allowed {
+		if until, banned := m.bans.BannedUntil(key); banned {
+			m.onBanned(w, r, key, until)
+			return Result{}, key, false
+		}
+	}
+
+	if m.sizes != nil && !m.checkSize(w, r, key) {
+		return Result{}, key, false
+	}
+
+	cost := m.cost(r)
+	if m.analyzer != nil {
+		c, err := m.analyzer.Analyze(r)
+		if err != nil {
+			var p Problem
+			if !errors.As(err, &p) {
+				p = NewProblem(http.StatusBadRequest, err.Error())
+			}
+			if p.Instance == "" {
+				p.Instance = r.URL.Path
+			}
+			p.ClientKey = key
+			WriteProblem(w, p)
+			return Result{}, key, false
+		}
+		cost = c
+	}
+
+	if allowed {
+		return Result{Allowed: true, Unlimited: true, Policy: "allowlist"}, key, true
+	}
+
+	var res Result
+	if rl, ok := m.limiter.(RequestLimiter); ok {
+		res = rl.TakeRequest(r, key, addr, cost)
+	} else {
+		res = m.limiter.Take(r.Context(), key, cost)
+	}
+
+	if !res.Allowed && m.bans != nil {
+		m.bans.Rejected(r.Context(), key)
+	}
+	if res.WouldReject && m.onShadowReject != nil {
+		m.onShadowReject(r, key, res)
+	}
+	return res, key, true
+}
+
+func (m *Middleware) SetHeaders(h http.Header, res Result) {
+	SetHeaders(h, res, m.legacyHeaders)
+}
@@ -0,0 +1,80 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+const (
+	ProblemContentType = "application/problem+json"
+
+	TypeRateLimited  = "urn:ratelimit:problem:rate-limited"
+	TypeUnidentified = "urn:ratelimit:problem:unidentified-client"
+)
+
+// Problem is an RFC 9457 problem details object. Rejections by a limit
+// carry the client key, the limit that tripped and when to retry.
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+
+	ClientKey string `json:"client_key,omitempty"`
+	Policy    string `json:"policy,omitempty"`
+	Limit     int64  `json:"limit,omitempty"`
+	// Window and RetryAfter are in seconds, like the RateLimit headers.
+	Window     int64 `json:"window,omitempty"`
+	RetryAfter int64 `json:"retry_after,omitempty"`
+}
+
+// NewProblem returns a problem without a specific type, which is described
+// by its status alone.
+func NewProblem(status int, detail string) Problem {
+	return Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	}
+}
+
+// Error makes a problem an error, for rejections decided deep down.
+func (p Problem) Error() string {
+	return p.Detail
+}
+
+// RateLimitedProblem describes the rejection of r by the limit in res.
+func RateLimitedProblem(r *http.Request, key string, res Result) Problem {
+	retryAfter := max(1, ceilSeconds(res.RetryAfter))
+	detail := "Rate limit exceeded, retry later."
+	if res.Limit > 0 {
+		detail = "Rate limit of " + formatLimit(res) + " exceeded, retry later."
+	}
+
+	return Problem{
+		Type:       TypeRateLimited,
+		Title:      "Too Many Requests",
+		Status:     http.StatusTooManyRequests,
+		Detail:     detail,
+		Instance:   r.URL.Path,
+		ClientKey:  key,
+		Policy:     res.Policy,
+		Limit:      res.Limit,
+		Window:     ceilSeconds(res.Window),
+		RetryAfter: retryAfter,
+	}
+}
+
+func WriteProblem(w http.ResponseWriter, p Problem) {
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	_ = json.NewEncoder(w).Encode(p)
+}
+
+func formatLimit(res Result) string {
+	return strconv.FormatInt(res.Limit, 10) + " requests per " + strconv.FormatInt(ceilSeconds(res.Window), 10) + "s"
+}
@@ -0,0 +1,314 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	TypeQueueFull    = "urn:ratelimit:problem:queue-full"
+	TypeQueueTimeout = "urn:ratelimit:problem:queue-timeout"
+)
+
+var (
+	ErrQueueFull    = errors.New("queue is full")
+	ErrQueueTimeout = errors.New("timed out waiting in queue")
+)
+
+// QueueOptions configure a FairQueue. Concurrency is the number of requests
+// served at once, MaxQueue the requests a single client may have waiting
+// and MaxWait how long they wait at most. Weight gives the number of
+// requests of a client served in a row, 1 for every client by default.
+// The queue and stats of a client without requests are dropped after
+// IdleTTL, 5 minutes if it is zero.
+type QueueOptions struct {
+	Concurrency int
+	MaxQueue    int
+	MaxWait     time.Duration
+	Weight      func(key string) int
+	IdleTTL     time.Duration
+}
+
+// QueueStats describes the queue of a client. Waits are in seconds.
+type QueueStats struct {
+	Key      string  `json:"key"`
+	Depth    int     `json:"depth"`
+	Running  int     `json:"running"`
+	Admitted int64   `json:"admitted"`
+	Rejected int64   `json:"rejected"`
+	TimedOut int64   `json:"timed_out"`
+	AvgWait  float64 `json:"avg_wait_seconds"`
+	MaxWait  float64 `json:"max_wait_seconds"`
+}
+
+// FairQueue lets a limited number of requests through at once. The others
+// wait in a queue per client, and the queues take turns by weight, so that
+// a single busy client cannot fill the whole backlog. Idle queues are kept
+// for their stats until IdleTTL has passed.
+type FairQueue struct {
+	opts QueueOptions
+
+	mu        sync.Mutex
+	running   int
+	queues    map[string]*clientQueue
+	lastSweep time.Time
+	// ring holds the keys with waiting requests in the order they are
+	// served, next is the one whose turn it is
+	ring []string
+	next int
+}
+
+type clientQueue struct {
+	waiters []*waiter
+	// served counts the requests served in a row in the current turn
+	served int
+
+	running   int
+	admitted  int64
+	rejected  int64
+	timedOut  int64
+	totalWait time.Duration
+	maxWait   time.Duration
+	// lastActive is when a request of the client last came or went
+	lastActive time.Time
+}
+
+type waiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+func NewFairQueue(opts QueueOptions) *FairQueue {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+	if opts.Weight == nil {
+		opts.Weight = func(string) int { return 1 }
+	}
+	if opts.IdleTTL <= 0 {
+		opts.IdleTTL = 5 * time.Minute
+	}
+	return &FairQueue{
+		opts:      opts,
+		queues:    make(map[string]*clientQueue),
+		lastSweep: time.Now(),
+	}
+}
+
+// Acquire waits for the turn of key and returns the function to call once
+// the request is done. It fails with ErrQueueFull if key has MaxQueue
+// requests waiting already, or ErrQueueTimeout after MaxWait.
+func (q *FairQueue) Acquire(ctx context.Context, key string) (func(), error) {
+	start := time.Now()
+
+	q.mu.Lock()
+	q.sweep(start)
+	cq := q.queue(key)
+	cq.lastActive = start
+	if q.running < q.opts.Concurrency && len(q.ring) == 0 {
+		q.admit(cq, 0)
+		q.mu.Unlock()
+		return q.releaser(cq), nil
+	}
+	if q.opts.MaxQueue > 0 && len(cq.waiters) >= q.opts.MaxQueue {
+		cq.rejected++
+		q.mu.Unlock()
+		return nil, ErrQueueFull
+	}
+
+	w := &waiter{ready: make(chan struct{})}
+	cq.waiters = append(cq.waiters, w)
+	if len(cq.waiters) == 1 {
+		q.ring = append(q.ring, key)
+	}
+	q.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if q.opts.MaxWait > 0 {
+		timer := time.NewTimer(q.opts.MaxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	err := ErrQueueTimeout
+	select {
+	case <-w.ready:
+		err = nil
+	case <-timeout:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	cq.lastActive = time.Now()
+	// the turn may have come while giving up
+	if w.granted {
+		wait := time.Since(start)
+		cq.totalWait += wait
+		cq.maxWait = max(cq.maxWait, wait)
+		return q.releaser(cq), nil
+	}
+
+	q.remove(key, cq, w)
+	if errors.Is(err, ErrQueueTimeout) {
+		cq.timedOut++
+	}
+	return nil, err
+}
+
+// Stats returns the stats of every client seen within IdleTTL, the deepest
+// queues first.
+func (q *FairQueue) Stats() []QueueStats {
+	if q == nil {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.sweep(time.Now())
+
+	stats := make([]QueueStats, 0, len(q.queues))
+	for key, cq := range q.queues {
+		s := QueueStats{
+			Key:      key,
+			Depth:    len(cq.waiters),
+			Running:  cq.running,
+			Admitted: cq.admitted,
+			Rejected: cq.rejected,
+			TimedOut: cq.timedOut,
+			MaxWait:  cq.maxWait.Seconds(),
+		}
+		if cq.admitted > 0 {
+			s.AvgWait = cq.totalWait.Seconds() / float64(cq.admitted)
+		}
+		stats = append(stats, s)
+	}
+
+	slices.SortFunc(stats, func(a, b QueueStats) int {
+		if a.Depth != b.Depth {
+			return b.Depth - a.Depth
+		}
+		if a.Key < b.Key {
+			return -1
+		}
+		return 1
+	})
+	return stats
+}
+
+// sweep drops the queues that have been idle for IdleTTL, at most once
+// every IdleTTL.
+func (q *FairQueue) sweep(now time.Time) {
+	if now.Sub(q.lastSweep) < q.opts.IdleTTL {
+		return
+	}
+	q.lastSweep = now
+
+	for key, cq := range q.queues {
+		if len(cq.waiters) == 0 && cq.running == 0 && now.Sub(cq.lastActive) >= q.opts.IdleTTL {
+			delete(q.queues, key)
+		}
+	}
+}
+
+func (q *FairQueue) queue(key string) *clientQueue {
+	cq, ok := q.queues[key]
+	if !ok {
+		cq = &clientQueue{}
+		q.queues[key] = cq
+	}
+	return cq
+}
+
+func (q *FairQueue) admit(cq *clientQueue, wait time.Duration) {
+	q.running++
+	cq.running++
+	cq.admitted++
+	cq.totalWait += wait
+	cq.maxWait = max(cq.maxWait, wait)
+}
+
+func (q *FairQueue) releaser(cq *clientQueue) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			q.running--
+			cq.running--
+			cq.lastActive = time.Now()
+			q.dispatch()
+		})
+	}
+}
+
+// dispatch hands free slots to the waiting requests, serving Weight
+// requests of a client before moving on to the next one.
+func (q *FairQueue) dispatch() {
+	for q.running < q.opts.Concurrency && len(q.ring) > 0 {
+		key := q.ring[q.next]
+		cq := q.queues[key]
+
+		w := cq.waiters[0]
+		cq.waiters = cq.waiters[1:]
+		w.granted = true
+		close(w.ready)
+
+		// the wait is added by Acquire, which knows when it started
+		q.admit(cq, 0)
+		cq.served++
+
+		switch {
+		case len(cq.waiters) == 0:
+			q.dropTurn(q.next, cq)
+		case cq.served >= max(1, q.opts.Weight(key)):
+			cq.served = 0
+			q.next = (q.next + 1) % len(q.ring)
+		}
+	}
+}
+
+func (q *FairQueue) remove(key string, cq *clientQueue, w *waiter) {
+	i := slices.Index(cq.waiters, w)
+	if i < 0 {
+		return
+	}
+	cq.waiters = slices.Delete(cq.waiters, i, i+1)
+	if len(cq.waiters) == 0 {
+		q.dropTurn(slices.Index(q.ring, key), cq)
+	}
+}
+
+// dropTurn takes the client at ring index i out of the rotation.
+func (q *FairQueue) dropTurn(i int, cq *clientQueue) {
+	cq.served = 0
+	q.ring = slices.Delete(q.ring, i, i+1)
+	if i < q.next {
+		q.next--
+	}
+	if q.next >= len(q.ring) {
+		q.next = 0
+	}
+}
+
+func writeQueueError(w http.ResponseWriter, r *http.Request, key string, err error, maxWait time.Duration) {
+	p := NewProblem(http.StatusServiceUnavailable, "Too many requests are waiting, retry later.")
+	p.Type = TypeQueueFull
+	p.Title = "Queue Full"
+	if errors.Is(err, ErrQueueTimeout) {
+		p.Type = TypeQueueTimeout
+		p.Title = "Queue Timeout"
+		p.Detail = "Timed out waiting in the queue, retry later."
+	}
+	p.Instance = r.URL.Path
+	p.ClientKey = key
+	p.RetryAfter = max(1, ceilSeconds(maxWait))
+	w.Header().Set("Retry-After", strconv.FormatInt(p.RetryAfter, 10))
+	WriteProblem(w, p)
+}
@@ -0,0 +1,76 @@
+// Package ratelimit limits clients with token buckets. A Limiter takes
+// tokens from the bucket of a client key, a Store keeps the buckets, and
+// Middleware limits the requests of an http.Handler:
+//
+//	limiter := ratelimit.NewLimiter(ratelimit.NewMemoryStore(), ratelimit.Limit{
+//		Capacity:   10,
+//		RefillRate: time.Second,
+//	})
+//	handler = ratelimit.NewMiddleware(limiter,
+//		ratelimit.WithKeys(ratelimit.HeaderKey("X-API-Key")),
+//	).Handler(handler)
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// Limit allows bursts of Capacity requests and adds a token every
+// RefillRate. Unlimited buckets never reject.
+type Limit struct {
+	Capacity   int64
+	RefillRate time.Duration
+	Unlimited  bool
+}
+
+type Result struct {
+	Allowed   bool  `json:"allowed"`
+	Unlimited bool  `json:"unlimited"`
+	Limit     int64 `json:"limit"`
+	Remaining int64 `json:"remaining"`
+	// ResetAfter is the time until the bucket is full again and RetryAfter
+	// the time until there are enough tokens, if the request was rejected.
+	ResetAfter time.Duration `json:"reset_after"`
+	RetryAfter time.Duration `json:"retry_after"`
+	// Window is the time the bucket takes to refill from empty.
+	Window time.Duration `json:"window"`
+	// Policy optionally names the limit the result comes from, e.g. a rule.
+	Policy string `json:"policy,omitempty"`
+	// Shadow is set for limits in shadow mode, which always allow the
+	// request. WouldReject tells whether the limit would have rejected it.
+	Shadow      bool `json:"shadow,omitempty"`
+	WouldReject bool `json:"would_reject,omitempty"`
+}
+
+// Limiter decides whether a client may spend cost tokens.
+type Limiter interface {
+	Take(ctx context.Context, key string, cost int64) Result
+}
+
+// MostRestrictive picks the result to report when a request counts against
+// several buckets: a rejection, a would-be rejection in shadow mode, or else
+// the bucket with the fewest tokens left.
+func MostRestrictive(a, b Result) Result {
+	switch {
+	case !a.Allowed:
+		return a
+	case !b.Allowed:
+		return b
+	case a.WouldReject:
+		return a
+	case b.WouldReject:
+		return b
+	case a.Shadow:
+		return b
+	case b.Shadow:
+		return a
+	case a.Unlimited:
+		return b
+	case b.Unlimited:
+		return a
+	case b.Remaining < a.Remaining:
+		return b
+	}
+	return a
+}
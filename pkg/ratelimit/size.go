@@ -0,0 +1,124 @@
+package ratelimit
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+const TypeRequestTooLarge = "urn:ratelimit:problem:request-too-large"
+
+// The limits a request can exceed, as reported to SizeGuard.Oversized.
+const (
+	LimitBodyBytes   = "body_bytes"
+	LimitHeaderCount = "header_count"
+	LimitHeaderBytes = "header_bytes"
+)
+
+// SizeLimits bound the size of a request. Zero fields are not limited.
+// Header bytes count the names and values of all header lines.
+type SizeLimits struct {
+	MaxBodyBytes   int64
+	MaxHeaderCount int
+	MaxHeaderBytes int64
+}
+
+// SizeGuard picks the size limits of a request and is told about every
+// request that exceeds them, with the name of the limit.
+type SizeGuard interface {
+	SizeLimits(r *http.Request, key string) SizeLimits
+	Oversized(r *http.Request, key string, limit string)
+}
+
+// checkSize rejects r if its headers are too large or it announces a body
+// that is, and limits the body otherwise. It reports false if the response
+// has been written.
+func (m *Middleware) checkSize(w http.ResponseWriter, r *http.Request, key string) bool {
+	limits := m.sizes.SizeLimits(r, key)
+
+	if limits.MaxHeaderCount > 0 || limits.MaxHeaderBytes > 0 {
+		var count int
+		var size int64
+		for name, values := range r.Header {
+			count += len(values)
+			for _, v := range values {
+				size += int64(len(name) + len(v))
+			}
+		}
+
+		switch {
+		case limits.MaxHeaderCount > 0 && count > limits.MaxHeaderCount:
+			m.rejectSize(w, r, key, LimitHeaderCount, http.StatusRequestHeaderFieldsTooLarge,
+				"The request has "+strconv.Itoa(count)+" header fields, at most "+strconv.Itoa(limits.MaxHeaderCount)+" are allowed.")
+			return false
+		case limits.MaxHeaderBytes > 0 && size > limits.MaxHeaderBytes:
+			m.rejectSize(w, r, key, LimitHeaderBytes, http.StatusRequestHeaderFieldsTooLarge,
+				"The request headers have "+strconv.FormatInt(size, 10)+" bytes, at most "+strconv.FormatInt(limits.MaxHeaderBytes, 10)+" are allowed.")
+			return false
+		}
+	}
+
+	if limits.MaxBodyBytes > 0 {
+		if r.ContentLength > limits.MaxBodyBytes {
+			m.rejectSize(w, r, key, LimitBodyBytes, http.StatusRequestEntityTooLarge, bodyTooLarge(limits.MaxBodyBytes))
+			return false
+		}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &sizedBody{
+				ReadCloser: http.MaxBytesReader(w, r.Body, limits.MaxBodyBytes),
+				oversized: func() {
+					m.sizes.Oversized(r, key, LimitBodyBytes)
+				},
+			}
+		}
+	}
+	return true
+}
+
+func (m *Middleware) rejectSize(w http.ResponseWriter, r *http.Request, key, limit string, status int, detail string) {
+	m.sizes.Oversized(r, key, limit)
+
+	p := NewProblem(status, detail)
+	p.Type = TypeRequestTooLarge
+	p.Instance = r.URL.Path
+	p.ClientKey = key
+	WriteProblem(w, p)
+}
+
+// BodyTooLargeProblem describes a request whose body turned out too large
+// while it was read, err is the error the read failed with. It reports
+// false if err is not about the body size.
+func BodyTooLargeProblem(r *http.Request, err error) (Problem, bool) {
+	var maxErr *http.MaxBytesError
+	if !errors.As(err, &maxErr) {
+		return Problem{}, false
+	}
+
+	p := NewProblem(http.StatusRequestEntityTooLarge, bodyTooLarge(maxErr.Limit))
+	p.Type = TypeRequestTooLarge
+	p.Instance = r.URL.Path
+	return p, true
+}
+
+func bodyTooLarge(limit int64) string {
+	return "The request body is over " + strconv.FormatInt(limit, 10) + " bytes."
+}
+
+// sizedBody reports the first read that runs over the limit of its
+// http.MaxBytesReader.
+type sizedBody struct {
+	io.ReadCloser
+	once      sync.Once
+	oversized func()
+}
+
+func (b *sizedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var maxErr *http.MaxBytesError
+	if err != nil && errors.As(err, &maxErr) {
+		b.once.Do(b.oversized)
+	}
+	return n, err
+}
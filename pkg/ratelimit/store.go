@@ -0,0 +1,71 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+)
+
+// Bucket is a token bucket kept by a Store.
+type Bucket interface {
+	TakeN(cost int64) Result
+}
+
+// Store keeps the bucket of every client key. Implementations may share
+// buckets between processes, the decision is up to the returned Bucket.
+type Store interface {
+	// Bucket returns the bucket of key, creating one with limit if there
+	// is none yet.
+	Bucket(ctx context.Context, key string, limit Limit) Bucket
+}
+
+// MemoryStore keeps token buckets in memory. Buckets are never evicted.
+type MemoryStore struct {
+	mu      sync.RWMutex
+	buckets map[string]*TokenBucket
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: make(map[string]*TokenBucket),
+	}
+}
+
+func (s *MemoryStore) Bucket(_ context.Context, key string, limit Limit) Bucket {
+	s.mu.RLock()
+	b, exists := s.buckets[key]
+	s.mu.RUnlock()
+
+	if exists {
+		return b
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b, exists = s.buckets[key]; exists {
+		return b
+	}
+
+	b = NewTokenBucket(limit)
+	s.buckets[key] = b
+	return b
+}
+
+func (s *MemoryStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.buckets, key)
+}
+
+// StoreLimiter limits every key by the same limit.
+type StoreLimiter struct {
+	store Store
+	limit Limit
+}
+
+func NewLimiter(store Store, limit Limit) *StoreLimiter {
+	return &StoreLimiter{store: store, limit: limit}
+}
+
+func (l *StoreLimiter) Take(ctx context.Context, key string, cost int64) Result {
+	return l.store.Bucket(ctx, key, l.limit).TakeN(cost)
+}
@@ -0,0 +1,218 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LimitedError is returned by a fail-fast Transport for requests that
+// exceed the limit.
+type LimitedError struct {
+	Key        string
+	RetryAfter time.Duration
+}
+
+func (e *LimitedError) Error() string {
+	return fmt.Sprintf("rate limit of %s exceeded, retry after %s", e.Key, e.RetryAfter)
+}
+
+// Transport limits outgoing requests with a token bucket per key, the host
+// by default. Requests over the limit wait for a token, or fail with a
+// LimitedError if the transport fails fast.
+//
+// Upstream responses adjust the local bucket: the tokens are lowered to
+// RateLimit-Remaining or X-RateLimit-Remaining, and no requests are sent
+// before Retry-After has passed, or before the reset if no requests remain.
+type Transport struct {
+	base     http.RoundTripper
+	limit    Limit
+	key      func(r *http.Request) string
+	failFast bool
+
+	mu    sync.Mutex
+	hosts map[string]*upstream
+}
+
+type upstream struct {
+	bucket *TokenBucket
+	// pausedUntil is set when the upstream asked us to back off
+	pausedUntil time.Time
+}
+
+type TransportOption func(*Transport)
+
+// WithBase sends the requests through base instead of
+// http.DefaultTransport.
+func WithBase(base http.RoundTripper) TransportOption {
+	return func(t *Transport) {
+		t.base = base
+	}
+}
+
+// WithTransportKey limits requests by the given key instead of the host.
+func WithTransportKey(key func(r *http.Request) string) TransportOption {
+	return func(t *Transport) {
+		t.key = key
+	}
+}
+
+// WithFailFast fails requests over the limit instead of waiting.
+func WithFailFast() TransportOption {
+	return func(t *Transport) {
+		t.failFast = true
+	}
+}
+
+func NewTransport(limit Limit, opts ...TransportOption) *Transport {
+	t := &Transport{
+		base:  http.DefaultTransport,
+		limit: limit,
+		key: func(r *http.Request) string {
+			return r.URL.Host
+		},
+		hosts: make(map[string]*upstream),
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+// minTransportWait keeps a request from spinning on a bucket that never
+// has a token, like one without capacity.
+const minTransportWait = 10 * time.Millisecond
+
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	key := t.key(r)
+	up := t.upstream(key)
+
+	for {
+		wait := t.pause(up)
+		if wait <= 0 {
+			res := up.bucket.Take()
+			if res.Allowed {
+				break
+			}
+			wait = res.RetryAfter
+		}
+		wait = max(wait, minTransportWait)
+
+		if t.failFast {
+			closeBody(r)
+			return nil, &LimitedError{Key: key, RetryAfter: wait}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-r.Context().Done():
+			timer.Stop()
+			closeBody(r)
+			return nil, r.Context().Err()
+		case <-timer.C:
+		}
+	}
+
+	resp, err := t.base.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+	t.adjust(up, resp)
+	return resp, nil
+}
+
+// closeBody closes the body of a request that is not sent, as a
+// RoundTripper has to even on errors.
+func closeBody(r *http.Request) {
+	if r.Body != nil {
+		r.Body.Close()
+	}
+}
+
+func (t *Transport) upstream(key string) *upstream {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	up, ok := t.hosts[key]
+	if !ok {
+		up = &upstream{bucket: NewTokenBucket(t.limit)}
+		t.hosts[key] = up
+	}
+	return up
+}
+
+func (t *Transport) pause(up *upstream) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return time.Until(up.pausedUntil)
+}
+
+func (t *Transport) adjust(up *upstream, resp *http.Response) {
+	now := time.Now()
+	h := resp.Header
+
+	var until time.Time
+	if d, ok := retryAfter(h.Get("Retry-After"), now); ok {
+		until = now.Add(d)
+		up.bucket.SetRemaining(0)
+	}
+
+	remaining, ok := headerInt(h, "RateLimit-Remaining", "X-RateLimit-Remaining")
+	if ok {
+		up.bucket.SetRemaining(remaining)
+		if remaining == 0 {
+			if reset, ok := headerInt(h, "RateLimit-Reset", "X-RateLimit-Reset"); ok {
+				if d := resetAfter(reset, now); now.Add(d).After(until) {
+					until = now.Add(d)
+				}
+			}
+		}
+	}
+
+	if until.IsZero() {
+		return
+	}
+	t.mu.Lock()
+	if until.After(up.pausedUntil) {
+		up.pausedUntil = until
+	}
+	t.mu.Unlock()
+}
+
+// retryAfter parses both forms of Retry-After, seconds and an HTTP date.
+func retryAfter(v string, now time.Time) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if date, err := http.ParseTime(v); err == nil {
+		return max(0, date.Sub(now)), true
+	}
+	return 0, false
+}
+
+// resetAfter reads a reset header, which is a number of seconds in the
+// RateLimit-* headers, but a unix timestamp in many X-RateLimit-* ones.
+func resetAfter(reset int64, now time.Time) time.Duration {
+	const epochThreshold = 1_000_000_000
+	if reset >= epochThreshold {
+		return max(0, time.Unix(reset, 0).Sub(now))
+	}
+	return time.Duration(reset) * time.Second
+}
+
+func headerInt(h http.Header, names ...string) (int64, bool) {
+	for _, name := range names {
+		if v := h.Get(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err == nil && n >= 0 {
+				return n, true
+			}
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,110 @@
+package ratelimit
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const TypeTooManyConnections = "urn:ratelimit:problem:too-many-connections"
+
+func isUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// connCounter counts the open connections of every key.
+type connCounter struct {
+	mu    sync.Mutex
+	count map[string]int64
+}
+
+func newConnCounter() *connCounter {
+	return &connCounter{count: make(map[string]int64)}
+}
+
+func (c *connCounter) acquire(key string, limit int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.count[key] >= limit {
+		return false
+	}
+	c.count[key]++
+	return true
+}
+
+func (c *connCounter) release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.count[key]--; c.count[key] <= 0 {
+		delete(c.count, key)
+	}
+}
+
+func writeTooManyConnections(w http.ResponseWriter, r *http.Request, key string, limit int64) {
+	p := NewProblem(http.StatusTooManyRequests, "At most "+strconv.FormatInt(limit, 10)+" connections are allowed at once.")
+	p.Type = TypeTooManyConnections
+	p.Title = "Too Many Connections"
+	p.Instance = r.URL.Path
+	p.ClientKey = key
+	p.Limit = limit
+	WriteProblem(w, p)
+}
+
+// limitedHijacker limits the reads from the connection a handler takes
+// over, including the bytes the server buffered before the hijack.
+type limitedHijacker struct {
+	http.ResponseWriter
+	limiter *ConnLimiter
+}
+
+func (w *limitedHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if n := brw.Reader.Buffered(); n > 0 {
+		buffered, err := brw.Reader.Peek(n)
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		conn = &bufferedConn{Conn: conn, buf: bytes.NewReader(bytes.Clone(buffered))}
+	}
+
+	limited := LimitConn(conn, w.limiter)
+	return limited, bufio.NewReadWriter(bufio.NewReader(limited), brw.Writer), nil
+}
+
+// bufferedConn reads the bytes in buf before the ones of the connection.
+type bufferedConn struct {
+	net.Conn
+	buf *bytes.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	if c.buf.Len() > 0 {
+		return c.buf.Read(p)
+	}
+	return c.Conn.Read(p)
+}
+
+func (w *limitedHijacker) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}